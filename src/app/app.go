@@ -1,15 +1,21 @@
 package app
 
 import (
+	"encoding/json"
 	"github.com/Sirupsen/logrus"
 	dockerLib "github.com/fsouza/go-dockerclient"
 	"github.com/swipely/iam-docker/src/docker"
 	"github.com/swipely/iam-docker/src/http"
 	"github.com/swipely/iam-docker/src/iam"
+	"github.com/swipely/iam-docker/src/metadata"
+	"github.com/swipely/iam-docker/src/proc"
 	"github.com/valyala/fasthttp"
 	"hash/fnv"
+	netHTTP "net/http"
 	"net/http/httputil"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -17,32 +23,104 @@ var (
 	log = logrus.WithField("prefix", "app")
 )
 
-// New creates a new application with the given config.
-func New(config *Config, dockerClient docker.RawClient, stsClient iam.STSClient) *App {
+// New creates a new application with the given config. The chained STS client
+// factory is used to assume roles with the credentials of another role.
+func New(config *Config, dockerClient docker.RawClient, stsClient iam.STSClient, chainedSTSClient iam.STSClientFactory) *App {
 	return &App{
-		Config:       config,
-		DockerClient: dockerClient,
-		STSClient:    stsClient,
+		Config:           config,
+		DockerClient:     dockerClient,
+		STSClient:        stsClient,
+		ChainedSTSClient: chainedSTSClient,
 	}
 }
 
-// Run starts the application asynchronously.
+// Run starts the application, and blocks until either a worker fails or the
+// process is asked to stop by SIGINT or SIGTERM. Credential refreshes are
+// stopped before it returns, so that pending changes to the credential cache
+// are saved. Nil is returned when the process was asked to stop.
 func (app *App) Run() error {
 	log.Info("Running the app")
 
 	errorChan := make(chan error)
-	containerStore := docker.NewContainerStore(app.DockerClient)
-	credentialStore := iam.NewCredentialStore(app.STSClient, app.randomSeed())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithField("error", err).Warn("Unable to fetch Hostname")
+	}
+	containerStore := docker.NewContainerStore(app.DockerClient, &docker.Config{
+		TagLabels:              app.Config.TagLabels,
+		TransitiveTagKeys:      app.Config.TransitiveTagKeys,
+		PolicyDir:              app.Config.SessionPolicyDir,
+		SessionNameTemplate:    app.Config.SessionNameTemplate,
+		SourceIdentityTemplate: app.Config.SourceIdentityTemplate,
+		Hostname:               hostname,
+		DefaultAccount:         app.Config.DefaultAccount,
+		DefaultPartition:       app.Config.DefaultPartition,
+		CredentialsIDKey:       app.Config.ECSCredentialsKey,
+	})
+	source := app.Config.CredentialSource
+	if source == nil {
+		source = iam.NewSTSSource(app.STSClient, app.ChainedSTSClient)
+	}
+	credentialStore := iam.NewCredentialStoreFromSource(source, app.randomSeed(), &iam.Config{
+		DefaultDuration: app.Config.SessionDuration,
+		ExternalIDs:     app.Config.ExternalIDs,
+		Chains:          app.Config.RoleChains,
+		IdleTimeout:     app.Config.CredentialIdleTimeout,
+		RefreshWorkers:  app.Config.RefreshWorkers,
+		Cache:           app.Config.CredentialCache,
+	})
 	eventHandler := docker.NewEventHandler(app.Config.EventHandlers, containerStore, credentialStore)
-	proxy := httputil.NewSingleHostReverseProxy(app.Config.MetaDataUpstream)
-	handler := http.NewIAMHandler(proxy, containerStore, credentialStore, app.Config.DisableUpstream)
+	upstream, err := app.upstreamHandler()
+	if err != nil {
+		return err
+	}
+	handlerConfig := &http.Config{
+		DisableUpstream: app.Config.DisableUpstream,
+		UpstreamAllow:   app.Config.UpstreamAllow,
+		UpstreamDeny:    app.Config.UpstreamDeny,
+		RequireToken:    app.Config.RequireToken,
+		ECSCredentials:  app.Config.ECSCredentials,
+	}
+	if app.Config.IdentifyHostNetwork {
+		handlerConfig.HostNetworkResolver = proc.NewContainerResolver(app.Config.ProcfsRoot)
+	}
+	handler := http.NewIAMHandler(upstream, containerStore, credentialStore, handlerConfig)
 
 	go app.containerSyncWorker(containerStore, credentialStore)
-	go app.refreshCredentialWorker(credentialStore)
+	stopRefresh := make(chan struct{})
+	refreshDone := make(chan struct{})
+	go app.refreshCredentialWorker(credentialStore, stopRefresh, refreshDone)
+	go app.reconcileRolesWorker(containerStore, credentialStore)
 	go app.httpWorker(handler, errorChan)
 	go app.eventWorker(eventHandler, errorChan)
+	if app.Config.DiagnosticsAddr != "" {
+		go app.diagnosticsWorker(credentialStore, errorChan)
+	}
 
-	return <-errorChan
+	select {
+	case err = <-errorChan:
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("Stopping")
+		err = nil
+	}
+	close(stopRefresh)
+	<-refreshDone
+	return err
+}
+
+// upstreamHandler serves requests which aren't answered by iam-docker itself,
+// either by proxying them to the metadata API or by emulating it.
+func (app *App) upstreamHandler() (netHTTP.Handler, error) {
+	if app.Config.EmulatedMetaData != nil {
+		log.WithFields(logrus.Fields{
+			"instance-id": app.Config.EmulatedMetaData.InstanceID,
+			"region":      app.Config.EmulatedMetaData.Region,
+		}).Info("Emulating the metadata API")
+		return metadata.NewEmulator(app.Config.EmulatedMetaData)
+	}
+	return httputil.NewSingleHostReverseProxy(app.Config.MetaDataUpstream), nil
 }
 
 func (app *App) containerSyncWorker(containerStore docker.ContainerStore, credentialStore iam.CredentialStore) {
@@ -63,14 +141,25 @@ func (app *App) containerSyncWorker(containerStore docker.ContainerStore, creden
 	}
 }
 
-func (app *App) refreshCredentialWorker(credentialStore iam.CredentialStore) {
-	timer := time.Tick(app.Config.CredentialRefreshPeriod)
+// refreshCredentialWorker refreshes each credential shortly before it expires,
+// until stop is closed. Done is closed once the refreshes have stopped.
+func (app *App) refreshCredentialWorker(credentialStore iam.CredentialStore, stop <-chan struct{}, done chan<- struct{}) {
 	wlog := log.WithFields(logrus.Fields{"worker": "refresh-credentials"})
 	wlog.Info("Starting")
+	credentialStore.RunRefreshScheduler(stop)
+	close(done)
+}
+
+// reconcileRolesWorker evicts the credentials of roles which no running
+// container uses.
+func (app *App) reconcileRolesWorker(containerStore docker.ContainerStore, credentialStore iam.CredentialStore) {
+	timer := time.Tick(app.Config.CredentialRefreshPeriod)
+	wlog := log.WithFields(logrus.Fields{"worker": "reconcile-roles"})
+	wlog.Info("Starting")
 
 	for range timer {
-		wlog.Debug("Refreshing credentials")
-		go credentialStore.RefreshCredentials()
+		wlog.Debug("Reconciling roles")
+		credentialStore.ReconcileRoles(containerStore.IAMRoles())
 	}
 }
 
@@ -92,6 +181,26 @@ func (app *App) httpWorker(handler fasthttp.RequestHandler, errorChan chan error
 	errorChan <- err
 }
 
+// diagnosticsWorker serves the state of the credential store on a separate
+// address, which should not be reachable by containers.
+func (app *App) diagnosticsWorker(credentialStore iam.CredentialStore, errorChan chan error) {
+	wlog := log.WithFields(logrus.Fields{"worker": "diagnostics"})
+	wlog.Info("Starting")
+	mux := netHTTP.NewServeMux()
+	mux.HandleFunc("/failures", func(writer netHTTP.ResponseWriter, request *netHTTP.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(writer).Encode(credentialStore.Failures())
+		if err != nil {
+			wlog.WithField("error", err.Error()).Warn("Unable to serialize JSON")
+		}
+	})
+	err := netHTTP.ListenAndServe(app.Config.DiagnosticsAddr, mux)
+	wlog.WithFields(logrus.Fields{
+		"error": err.Error(),
+	}).Error("Failed to serve diagnostics")
+	errorChan <- err
+}
+
 func (app *App) eventWorker(eventHandler docker.EventHandler, errorChan chan error) {
 	wlog := log.WithFields(logrus.Fields{"worker": "event-handler"})
 	wlog.Info("Starting")
@@ -125,16 +234,16 @@ func (app *App) syncRunningContainers(containerStore docker.ContainerStore, cred
 			"error": err.Error(),
 		}).Warn("Failed syncing running containers")
 	}
-	for _, arn := range containerStore.IAMRoles() {
-		_, err := credentialStore.CredentialsForRole(arn)
+	for _, role := range containerStore.IAMRoles() {
+		_, err := credentialStore.CredentialsForRole(role)
 		if err != nil {
 			logger.WithFields(logrus.Fields{
-				"arn":   arn,
+				"arn":   role.ARN,
 				"error": err.Error(),
 			}).Warn("Unable to fetch credential")
 		} else {
 			logger.WithFields(logrus.Fields{
-				"arn": arn,
+				"arn": role.ARN,
 			}).Info("Successfully fetched credential")
 		}
 	}
@@ -3,25 +3,55 @@ package app
 import (
 	"github.com/swipely/iam-docker/src/docker"
 	"github.com/swipely/iam-docker/src/iam"
+	"github.com/swipely/iam-docker/src/metadata"
 	"net/url"
+	"text/template"
 	"time"
 )
 
 // App holds the state of the application.
 type App struct {
-	Config       *Config
-	DockerClient docker.RawClient
-	STSClient    iam.STSClient
+	Config           *Config
+	DockerClient     docker.RawClient
+	STSClient        iam.STSClient
+	ChainedSTSClient iam.STSClientFactory
 }
 
 // Config holds application configuration
 type Config struct {
 	ListenAddr              string
+	DiagnosticsAddr         string
 	MetaDataUpstream        *url.URL
 	EventHandlers           int
 	ReadTimeout             time.Duration
 	WriteTimeout            time.Duration
 	DockerSyncPeriod        time.Duration
 	CredentialRefreshPeriod time.Duration
+	CredentialIdleTimeout   time.Duration
+	RefreshWorkers          int
+	DefaultAccount          string
+	DefaultPartition        string
+	SessionDuration         time.Duration
+	ExternalIDs             map[string]string
+	RoleChains              map[string][]string
+	TagLabels               map[string]string
+	TransitiveTagKeys       []string
+	SessionPolicyDir        string
+	SessionNameTemplate     *template.Template
+	SourceIdentityTemplate  *template.Template
 	DisableUpstream         bool
+	UpstreamAllow           []string
+	UpstreamDeny            []string
+	RequireToken            bool
+	ECSCredentials          bool
+	IdentifyHostNetwork     bool
+	ProcfsRoot              string
+	// ECSCredentialsKey derives the ECS credentials ID of each container.
+	ECSCredentialsKey []byte
+	// CredentialSource issues credentials in place of STS when set.
+	CredentialSource iam.CredentialSource
+	// CredentialCache persists credentials across restarts when set.
+	CredentialCache iam.CredentialCache
+	// EmulatedMetaData is served in place of MetaDataUpstream when set.
+	EmulatedMetaData *metadata.Config
 }
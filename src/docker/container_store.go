@@ -1,16 +1,51 @@
 package docker
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	dockerClient "github.com/fsouza/go-dockerclient"
+	iam "github.com/swipely/iam-docker/src/iam"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	iamLabel               = "com.swipely.iam-docker.iam-profile"
 	iamEnvironmentVariable = "IAM_ROLE"
+	durationLabel          = "com.swipely.iam-docker.session-duration"
+	externalIDLabel        = "com.swipely.iam-docker.external-id"
+	policyLabel            = "com.swipely.iam-docker.session-policy"
+	policyFileLabel        = "com.swipely.iam-docker.session-policy-file"
+	policyARNsLabel        = "com.swipely.iam-docker.session-policy-arns"
+	chainLabel             = "com.swipely.iam-docker.role-chain"
+	defaultPartition       = "aws"
+	minSessionDuration     = 15 * time.Minute
+	maxSessionDuration     = 12 * time.Hour
+	maxTags                = 50
+	maxTagKeyLength        = 128
+	maxTagValueLength      = 256
+	maxPolicyLength        = 2048
+	maxPolicyARNs          = 10
+	shortIDLength          = 12
+	minSessionNameLength   = 2
+	maxSessionNameLength   = 64
+	hostNetworkMode        = "host"
+	metadataLabelPrefix    = "com.swipely.iam-docker.meta."
+	metadataPathPrefix     = "meta-data/"
 	retrySleepBase         = time.Second
 	retrySleepMultiplier   = 2
 	maxRetries             = 3
@@ -21,14 +56,22 @@ var (
 		All:  false,
 		Size: false,
 	}
+	roleARNPattern          = regexp.MustCompile(`^arn:(aws|aws-cn|aws-us-gov):iam::[0-9]{12}:role/([\w+=,.@-]+/)*[\w+=,.@-]{1,64}$`)
+	roleNamePattern         = regexp.MustCompile(`^([\w+=,.@-]+/)*[\w+=,.@-]{1,64}$`)
+	policyARNPattern        = regexp.MustCompile(`^arn:aws[a-z-]*:iam::([0-9]{12}|aws):policy/.+$`)
+	sessionNameInvalidChars = regexp.MustCompile(`[^\w+=,.@-]+`)
+	tagPattern              = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
 )
 
 // NewContainerStore creates an empty container store.
-func NewContainerStore(client RawClient) ContainerStore {
+func NewContainerStore(client RawClient, config *Config) ContainerStore {
 	return &containerStore{
-		containerIDsByIP:    make(map[string]string),
-		configByContainerID: make(map[string]containerConfig),
-		client:              client,
+		config:                      config,
+		containerIDsByIP:            make(map[string]map[string]string),
+		networksByGateway:           make(map[string]map[string]bool),
+		containerIDsByCredentialsID: make(map[string]string),
+		configByContainerID:         make(map[string]containerConfig),
+		client:                      client,
 	}
 }
 
@@ -40,36 +83,35 @@ func (store *containerStore) AddContainerByID(id string) error {
 		return err
 	}
 
-	for _, ip := range config.ips {
+	for _, address := range config.addresses {
 		logger.WithFields(logrus.Fields{
-			"ip":   ip,
-			"role": config.iamRole,
+			"network": address.network,
+			"ip":      address.ip,
+			"role":    config.iamRole.ARN,
 		}).Debug("Adding new container")
 	}
 
+	store.removeStaleContainers(config)
+
 	store.mutex.Lock()
-	for _, ip := range config.ips {
-		store.containerIDsByIP[ip] = config.id
-	}
-	store.configByContainerID[config.id] = *config
-	store.mutex.Unlock()
+	defer store.mutex.Unlock()
 
-	return nil
+	return store.addConfig(config)
 }
 
-func (store *containerStore) IAMRoles() []string {
+func (store *containerStore) IAMRoles() []*iam.Role {
 	log.Debug("Fetching unique IAM Roles in the store")
 
 	store.mutex.RLock()
-	iamSet := make(map[string]bool, len(store.configByContainerID))
+	iamSet := make(map[string]*iam.Role, len(store.configByContainerID))
 	for _, config := range store.configByContainerID {
-		iamSet[config.iamRole] = true
+		iamSet[config.iamRole.Key()] = config.iamRole
 	}
 	store.mutex.RUnlock()
 
-	iamRoles := make([]string, len(iamSet))
+	iamRoles := make([]*iam.Role, len(iamSet))
 	count := 0
-	for role := range iamSet {
+	for _, role := range iamSet {
 		iamRoles[count] = role
 		count++
 	}
@@ -77,7 +119,7 @@ func (store *containerStore) IAMRoles() []string {
 	return iamRoles
 }
 
-func (store *containerStore) IAMRoleForID(id string) (string, error) {
+func (store *containerStore) IAMRoleForID(id string) (*iam.Role, error) {
 	log.WithField("id", id).Debug("Looking up IAM role")
 
 	store.mutex.RLock()
@@ -85,31 +127,128 @@ func (store *containerStore) IAMRoleForID(id string) (string, error) {
 
 	config, hasKey := store.configByContainerID[id]
 	if !hasKey {
-		return "", fmt.Errorf("Unable to find config for container: %s", id)
+		return nil, fmt.Errorf("Unable to find config for container: %s", id)
 	}
 
 	return config.iamRole, nil
 }
 
-func (store *containerStore) IAMRoleForIP(ip string) (string, error) {
+func (store *containerStore) IAMRoleForIP(ip string) (*iam.Role, error) {
 	log.WithField("ip", ip).Debug("Looking up IAM role")
 
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	id, hasKey := store.containerIDsByIP[ip]
+	id, err := store.containerIDForAddress("", normalizeIP(ip))
+	if err != nil {
+		return nil, err
+	}
+
+	config, hasKey := store.configByContainerID[id]
 	if !hasKey {
-		return "", fmt.Errorf("Unable to find container for IP: %s", ip)
+		return nil, fmt.Errorf("Unable to find config for container: %s", id)
+	}
+
+	return config.iamRole, nil
+}
+
+func (store *containerStore) ContainerIDForAddress(localIP string, remoteIP string) (string, error) {
+	log.WithFields(logrus.Fields{
+		"local-ip":  localIP,
+		"remote-ip": remoteIP,
+	}).Debug("Looking up container")
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.containerIDForAddress(normalizeIP(localIP), normalizeIP(remoteIP))
+}
+
+// containerIDForAddress finds the container with the remote IP on the network
+// whose gateway is the local IP. When the local IP isn't the gateway of any
+// known network, the remote IP must be unique across all networks. Gateways are
+// remembered after their containers are removed, so that requests from a known
+// network never fall back to matching by IP alone. The caller must hold the
+// read lock.
+func (store *containerStore) containerIDForAddress(localIP string, remoteIP string) (string, error) {
+	idsByNetwork := store.containerIDsByIP[remoteIP]
+	networks := store.networksByGateway[localIP]
+
+	if len(networks) > 0 {
+		matches := make([]string, 0, 1)
+		for network, id := range idsByNetwork {
+			if networks[network] {
+				matches = append(matches, id)
+			}
+		}
+		if len(matches) == 1 {
+			return matches[0], nil
+		} else if len(matches) == 0 {
+			return "", fmt.Errorf("Unable to find container for IP %s on the network with gateway %s", remoteIP, localIP)
+		}
+		return "", fmt.Errorf("Multiple containers found for IP %s on networks with gateway %s", remoteIP, localIP)
+	}
+
+	if len(idsByNetwork) == 0 {
+		return "", fmt.Errorf("Unable to find container for IP: %s", remoteIP)
+	} else if len(idsByNetwork) > 1 {
+		return "", fmt.Errorf("Multiple containers found for IP %s, unable to determine the network", remoteIP)
+	}
+	for _, id := range idsByNetwork {
+		return id, nil
+	}
+	return "", fmt.Errorf("Unable to find container for IP: %s", remoteIP)
+}
+
+func (store *containerStore) IAMRoleForCredentialsID(credentialsID string) (*iam.Role, error) {
+	log.Debug("Looking up IAM role by credentials ID")
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	id, hasKey := store.containerIDsByCredentialsID[credentialsID]
+	if !hasKey {
+		return nil, fmt.Errorf("Unable to find container for credentials ID")
 	}
 
 	config, hasKey := store.configByContainerID[id]
 	if !hasKey {
-		return "", fmt.Errorf("Unable to find config for container: %s", id)
+		return nil, fmt.Errorf("Unable to find config for container: %s", id)
 	}
 
 	return config.iamRole, nil
 }
 
+func (store *containerStore) CredentialsIDForID(id string) (string, error) {
+	log.WithField("id", id).Debug("Looking up credentials ID")
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	config, hasKey := store.configByContainerID[id]
+	if !hasKey {
+		return "", fmt.Errorf("Unable to find config for container: %s", id)
+	} else if config.credentialsID == "" {
+		return "", fmt.Errorf("No credentials ID for container: %s", id)
+	}
+
+	return config.credentialsID, nil
+}
+
+func (store *containerStore) MetadataForID(id string) (map[string]string, error) {
+	log.WithField("id", id).Debug("Looking up metadata")
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	config, hasKey := store.configByContainerID[id]
+	if !hasKey {
+		return nil, fmt.Errorf("Unable to find config for container: %s", id)
+	}
+
+	return config.metadata, nil
+}
+
 func (store *containerStore) RemoveContainer(id string) {
 	store.mutex.RLock()
 	config, hasKey := store.configByContainerID[id]
@@ -118,10 +257,7 @@ func (store *containerStore) RemoveContainer(id string) {
 	if hasKey {
 		log.WithField("id", id).Debug("Removing container")
 		store.mutex.Lock()
-		for _, ip := range config.ips {
-			delete(store.containerIDsByIP, ip)
-		}
-		delete(store.configByContainerID, id)
+		store.removeConfig(&config)
 		store.mutex.Unlock()
 	}
 
@@ -139,21 +275,34 @@ func (store *containerStore) SyncRunningContainers() error {
 	defer store.mutex.Unlock()
 
 	count := len(apiContainers)
-	store.containerIDsByIP = make(map[string]string, count)
+	store.containerIDsByIP = make(map[string]map[string]string, count)
+	store.networksByGateway = make(map[string]map[string]bool)
+	store.containerIDsByCredentialsID = make(map[string]string, count)
 	store.configByContainerID = make(map[string]containerConfig, count)
 
 	for _, container := range apiContainers {
 		config, err := store.findConfigForID(container.ID)
-		if err == nil {
-			for _, ip := range config.ips {
-				log.WithFields(logrus.Fields{
-					"id":   config.id,
-					"ip":   ip,
-					"role": config.iamRole,
-				}).Debug("Adding new container")
-				store.containerIDsByIP[ip] = config.id
-			}
-			store.configByContainerID[config.id] = *config
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"id":    container.ID,
+				"error": err.Error(),
+			}).Debug("Skipping container")
+			continue
+		}
+		for _, address := range config.addresses {
+			log.WithFields(logrus.Fields{
+				"id":      config.id,
+				"network": address.network,
+				"ip":      address.ip,
+				"role":    config.iamRole.ARN,
+			}).Debug("Adding new container")
+		}
+		err = store.addConfig(config)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"id":    config.id,
+				"error": err.Error(),
+			}).Warn("Unable to add container")
 		}
 	}
 
@@ -184,28 +333,463 @@ func (store *containerStore) findConfigForID(id string) (*containerConfig, error
 			return nil, fmt.Errorf("Unable to find label named '%s' or environment variable '%s' for container: %s", iamLabel, iamEnvironmentVariable, id)
 		}
 	}
+	iamRole, err = store.resolveRoleARN(iamRole)
+	if err != nil {
+		return nil, fmt.Errorf("Rejecting IAM role of container %s: %s", id, err.Error())
+	}
 
-	ips := make([]string, 0, 2)
-	for _, network := range container.NetworkSettings.Networks {
-		ip := network.IPAddress
-		if ip != "" {
-			ips = append(ips, ip)
+	addresses := make([]containerAddress, 0, 2)
+	gateways := make(map[string][]string, len(container.NetworkSettings.Networks))
+	for name, network := range container.NetworkSettings.Networks {
+		key := network.NetworkID
+		if key == "" {
+			key = name
+		}
+		for _, ip := range []string{network.IPAddress, network.GlobalIPv6Address} {
+			if ip != "" {
+				addresses = append(addresses, containerAddress{network: key, ip: normalizeIP(ip)})
+			}
+		}
+		for _, gateway := range []string{network.Gateway, network.IPv6Gateway} {
+			if gateway != "" {
+				gateways[key] = append(gateways[key], normalizeIP(gateway))
+			}
 		}
 	}
 
-	if len(ips) == 0 {
+	// Containers in the host's network namespace have no addresses of their
+	// own, and can only be identified by the owner of their sockets.
+	hostNetwork := (container.HostConfig != nil) && (container.HostConfig.NetworkMode == hostNetworkMode)
+	if (len(addresses) == 0) && !hostNetwork {
 		return nil, fmt.Errorf("Unable to find IP address for container: %s", id)
 	}
 
+	duration, err := durationForContainer(container)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := store.tagsForContainer(container)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := store.policyForContainer(container)
+	if err != nil {
+		return nil, err
+	}
+
+	policyARNs, err := policyARNsForContainer(container)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := store.sessionAttributesForContainer(container)
+	sessionName, err := renderSessionName(store.config.SessionNameTemplate, attributes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to render session name for container %s: %s", id, err.Error())
+	}
+	sourceIdentity, err := renderSessionName(store.config.SourceIdentityTemplate, attributes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to render source identity for container %s: %s", id, err.Error())
+	}
+
+	role := &iam.Role{
+		ARN:            iamRole,
+		Duration:       duration,
+		ExternalID:     container.Config.Labels[externalIDLabel],
+		Tags:           tags,
+		Policy:         policy,
+		PolicyARNs:     policyARNs,
+		SessionName:    sessionName,
+		SourceIdentity: sourceIdentity,
+	}
+	if len(tags) > 0 {
+		role.TransitiveTagKeys = transitiveTagKeys(tags, store.config.TransitiveTagKeys)
+	}
+	if chain, hasLabel := container.Config.Labels[chainLabel]; hasLabel {
+		// An empty chain overrides the configured chain, assuming the role
+		// directly.
+		role.Chain = make([]string, 0)
+		for _, hop := range strings.Split(chain, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop == "" {
+				continue
+			}
+			hop, err = store.resolveRoleARN(hop)
+			if err != nil {
+				return nil, fmt.Errorf("Rejecting role chain of container %s: %s", id, err.Error())
+			}
+			role.Chain = append(role.Chain, hop)
+		}
+	}
+
 	config := &containerConfig{
-		id:      id,
-		ips:     ips,
-		iamRole: iamRole,
+		id:            id,
+		addresses:     addresses,
+		gateways:      gateways,
+		iamRole:       role,
+		credentialsID: store.credentialsIDForContainer(id),
+		metadata:      metadataForContainer(container),
 	}
 
 	return config, nil
 }
 
+// resolveRoleARN validates the role's ARN, resolving role names with the
+// store's config.
+func (store *containerStore) resolveRoleARN(role string) (string, error) {
+	return ResolveRoleARN(role, store.config)
+}
+
+// ResolveRoleARN validates the role's ARN. Roles which are given by their name,
+// optionally with a path, belong to the config's default account and
+// partition.
+func ResolveRoleARN(role string, config *Config) (string, error) {
+	role = strings.TrimSpace(role)
+	if strings.HasPrefix(role, "arn:") {
+		if !roleARNPattern.MatchString(role) {
+			return "", fmt.Errorf("Expected arn:<aws|aws-cn|aws-us-gov>:iam::<account ID>:role/[<path>/]<name>, got: %s", role)
+		}
+		return role, nil
+	}
+
+	name := strings.TrimPrefix(role, "/")
+	if !roleNamePattern.MatchString(name) {
+		return "", fmt.Errorf("Expected a role ARN, <name> or <path>/<name>, got: %s", role)
+	} else if config.DefaultAccount == "" {
+		return "", fmt.Errorf("No default account is configured for role name: %s", role)
+	}
+	partition := config.DefaultPartition
+	if partition == "" {
+		partition = defaultPartition
+	}
+	arn := fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, config.DefaultAccount, name)
+	if !roleARNPattern.MatchString(arn) {
+		return "", fmt.Errorf("Invalid default account or partition for role name %s: %s", role, arn)
+	}
+	return arn, nil
+}
+
+// removeStaleContainers removes the containers which hold any of the config's
+// addresses but are no longer running. Docker reuses the addresses of stopped
+// containers, and their events may be handled after the start event of the
+// container which reuses the address. Containers which can't be inspected are
+// kept, so that the new container is refused rather than given their address.
+func (store *containerStore) removeStaleContainers(config *containerConfig) {
+	conflicts := make(map[string]bool)
+	store.mutex.RLock()
+	for _, address := range config.addresses {
+		existing, hasKey := store.containerIDsByIP[address.ip][address.network]
+		if hasKey && (existing != config.id) {
+			conflicts[existing] = true
+		}
+	}
+	store.mutex.RUnlock()
+
+	for id := range conflicts {
+		container, err := store.client.InspectContainer(id)
+		if err != nil {
+			if _, isMissing := err.(*dockerClient.NoSuchContainer); !isMissing {
+				continue
+			}
+		} else if (container != nil) && container.State.Running {
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"id":          id,
+			"replacement": config.id,
+		}).Info("Removing container which is no longer running")
+		store.RemoveContainer(id)
+	}
+}
+
+// addConfig indexes the config by its network addresses and credentials ID.
+// Registrations which conflict with another container are refused, rather
+// than overwriting that container's. The caller must hold the write lock.
+func (store *containerStore) addConfig(config *containerConfig) error {
+	for _, address := range config.addresses {
+		existing, hasKey := store.containerIDsByIP[address.ip][address.network]
+		if hasKey && (existing != config.id) {
+			return fmt.Errorf("IP %s on network %s for container %s is already used by container: %s", address.ip, address.network, config.id, existing)
+		}
+	}
+
+	previous, hasKey := store.configByContainerID[config.id]
+	if hasKey {
+		store.removeConfig(&previous)
+	}
+
+	for _, address := range config.addresses {
+		idsByNetwork, hasKey := store.containerIDsByIP[address.ip]
+		if !hasKey {
+			idsByNetwork = make(map[string]string, 1)
+			store.containerIDsByIP[address.ip] = idsByNetwork
+		}
+		idsByNetwork[address.network] = config.id
+	}
+	for network, gateways := range config.gateways {
+		for _, gateway := range gateways {
+			networks, hasKey := store.networksByGateway[gateway]
+			if !hasKey {
+				networks = make(map[string]bool, 1)
+				store.networksByGateway[gateway] = networks
+			}
+			networks[network] = true
+		}
+	}
+	if config.credentialsID != "" {
+		store.containerIDsByCredentialsID[config.credentialsID] = config.id
+	}
+	store.configByContainerID[config.id] = *config
+
+	return nil
+}
+
+// removeConfig removes the config from each index. The caller must hold the
+// write lock.
+func (store *containerStore) removeConfig(config *containerConfig) {
+	for _, address := range config.addresses {
+		idsByNetwork := store.containerIDsByIP[address.ip]
+		if idsByNetwork[address.network] == config.id {
+			delete(idsByNetwork, address.network)
+			if len(idsByNetwork) == 0 {
+				delete(store.containerIDsByIP, address.ip)
+			}
+		}
+	}
+	if store.containerIDsByCredentialsID[config.credentialsID] == config.id {
+		delete(store.containerIDsByCredentialsID, config.credentialsID)
+	}
+	delete(store.configByContainerID, config.id)
+}
+
+// metadataForContainer determines the metadata which is served to the
+// container instead of the host's, keyed by the path below the API version.
+// The hostname is the container's name, and labels such as
+// `com.swipely.iam-docker.meta.placement/region` override the path below
+// `meta-data/`.
+func metadataForContainer(container *dockerClient.Container) map[string]string {
+	metadata := make(map[string]string)
+	name := strings.TrimPrefix(container.Name, "/")
+	if name != "" {
+		metadata[metadataPathPrefix+"hostname"] = name
+		metadata[metadataPathPrefix+"local-hostname"] = name
+	}
+	for label, value := range container.Config.Labels {
+		if !strings.HasPrefix(label, metadataLabelPrefix) {
+			continue
+		}
+		path := strings.Trim(label[len(metadataLabelPrefix):], "/")
+		if path != "" {
+			metadata[metadataPathPrefix+path] = value
+		}
+	}
+	return metadata
+}
+
+// durationForContainer determines the session duration requested by the
+// container's label, given either in seconds or as a duration such as `12h`.
+// When there is no label, the duration is zero so that the default is used.
+func durationForContainer(container *dockerClient.Container) (time.Duration, error) {
+	value, hasLabel := container.Config.Labels[durationLabel]
+	if !hasLabel {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.ParseInt(value, 10, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("Invalid session duration '%s' for container: %s", value, container.ID)
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	if (duration < minSessionDuration) || (duration > maxSessionDuration) {
+		return 0, fmt.Errorf("Session duration must be between %s and %s for container: %s", minSessionDuration, maxSessionDuration, container.ID)
+	}
+	return duration, nil
+}
+
+// tagsForContainer determines the session tags of the container from its
+// labels. Labels which would be rejected by STS cause the container to be
+// rejected, rather than failing each time its credentials are requested.
+func (store *containerStore) tagsForContainer(container *dockerClient.Container) (map[string]string, error) {
+	tags := make(map[string]string)
+	for label, key := range store.config.TagLabels {
+		value, hasLabel := container.Config.Labels[label]
+		if !hasLabel {
+			continue
+		}
+		if (len(key) == 0) || (len(key) > maxTagKeyLength) || !tagPattern.MatchString(key) {
+			return nil, fmt.Errorf("Invalid session tag key '%s' for container: %s", key, container.ID)
+		} else if (len(value) > maxTagValueLength) || !tagPattern.MatchString(value) {
+			return nil, fmt.Errorf("Invalid value for session tag '%s' for container: %s", key, container.ID)
+		}
+		tags[key] = value
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("More than %d session tags for container: %s", maxTags, container.ID)
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
+
+// transitiveTagKeys returns the sorted transitive tag keys which the container
+// has tags for.
+func transitiveTagKeys(tags map[string]string, keys []string) []string {
+	transitive := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, hasKey := tags[key]; hasKey {
+			transitive = append(transitive, key)
+		}
+	}
+	if len(transitive) == 0 {
+		return nil
+	}
+	sort.Strings(transitive)
+	return transitive
+}
+
+// policyForContainer determines the session policy of the container, which is
+// either given inline by its label or is the name of a file in the policy
+// directory. The policy is compacted so that containers with equivalent
+// policies share credentials.
+func (store *containerStore) policyForContainer(container *dockerClient.Container) (string, error) {
+	policy, hasPolicy := container.Config.Labels[policyLabel]
+	name, hasFile := container.Config.Labels[policyFileLabel]
+	if hasPolicy && hasFile {
+		return "", fmt.Errorf("Only one of '%s' and '%s' may be set for container: %s", policyLabel, policyFileLabel, container.ID)
+	} else if hasFile {
+		if store.config.PolicyDir == "" {
+			return "", fmt.Errorf("Session policy files are not enabled, unable to read '%s' for container: %s", name, container.ID)
+		} else if (name == "") || (name != filepath.Base(name)) || strings.HasPrefix(name, ".") {
+			return "", fmt.Errorf("Invalid session policy file name '%s' for container: %s", name, container.ID)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(store.config.PolicyDir, name))
+		if err != nil {
+			return "", fmt.Errorf("Unable to read session policy file '%s' for container %s: %s", name, container.ID, err.Error())
+		}
+		policy = string(content)
+	} else if !hasPolicy {
+		return "", nil
+	}
+
+	buffer := &bytes.Buffer{}
+	err := json.Compact(buffer, []byte(policy))
+	if err != nil {
+		return "", fmt.Errorf("Invalid session policy JSON for container %s: %s", container.ID, err.Error())
+	}
+	var document policyDocument
+	err = json.Unmarshal(buffer.Bytes(), &document)
+	if err != nil {
+		return "", fmt.Errorf("Session policy is not a policy document for container %s: %s", container.ID, err.Error())
+	} else if (document.Version == "") || !isPolicyStatement(document.Statement) {
+		return "", fmt.Errorf("Session policy requires a Version and Statement for container: %s", container.ID)
+	} else if utf8.RuneCount(buffer.Bytes()) > maxPolicyLength {
+		return "", fmt.Errorf("Session policy is longer than %d characters for container: %s", maxPolicyLength, container.ID)
+	}
+	return buffer.String(), nil
+}
+
+// isPolicyStatement determines whether the compacted JSON is a statement
+// object or a list of them.
+func isPolicyStatement(statement json.RawMessage) bool {
+	return (len(statement) > 0) && ((statement[0] == '{') || (statement[0] == '['))
+}
+
+// policyARNsForContainer determines the managed session policies of the
+// container from its comma-separated label.
+func policyARNsForContainer(container *dockerClient.Container) ([]string, error) {
+	value := container.Config.Labels[policyARNsLabel]
+	policyARNs := make([]string, 0)
+	for _, policyARN := range strings.Split(value, ",") {
+		policyARN = strings.TrimSpace(policyARN)
+		if policyARN == "" {
+			continue
+		} else if !policyARNPattern.MatchString(policyARN) {
+			return nil, fmt.Errorf("Invalid session policy ARN '%s' for container: %s", policyARN, container.ID)
+		}
+		policyARNs = append(policyARNs, policyARN)
+	}
+	if len(policyARNs) > maxPolicyARNs {
+		return nil, fmt.Errorf("More than %d session policy ARNs for container: %s", maxPolicyARNs, container.ID)
+	} else if len(policyARNs) == 0 {
+		return nil, nil
+	}
+	sort.Strings(policyARNs)
+	return policyARNs, nil
+}
+
+// sessionAttributesForContainer describes the container to the session name
+// and source identity templates.
+func (store *containerStore) sessionAttributesForContainer(container *dockerClient.Container) *SessionAttributes {
+	id := container.ID
+	if len(id) > shortIDLength {
+		id = id[:shortIDLength]
+	}
+	image := container.Config.Image
+	if image == "" {
+		image = container.Image
+	}
+	return &SessionAttributes{
+		ID:    id,
+		Name:  strings.TrimPrefix(container.Name, "/"),
+		Image: image,
+		Host:  store.config.Hostname,
+	}
+}
+
+// renderSessionName renders the template, then replaces the characters which
+// STS doesn't allow in session names and source identities, and truncates it
+// to their maximum length. When there's no template, or the result is too
+// short, the name is empty.
+func renderSessionName(tmpl *template.Template, attributes *SessionAttributes) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+	buffer := &bytes.Buffer{}
+	err := tmpl.Execute(buffer, attributes)
+	if err != nil {
+		return "", err
+	}
+	name := sessionNameInvalidChars.ReplaceAllString(buffer.String(), "-")
+	if len(name) > maxSessionNameLength {
+		name = name[:maxSessionNameLength]
+	} else if len(name) < minSessionNameLength {
+		return "", nil
+	}
+	return name, nil
+}
+
+// credentialsIDForContainer determines the ID used by the ECS container
+// credentials endpoint, which is the HMAC of the container ID. Containers can't
+// choose their own ID, and the ID can't be guessed without the key. It stays
+// the same for the life of the container, and across restarts of the agent
+// when the key does. Without a key, containers have no credentials ID.
+func (store *containerStore) credentialsIDForContainer(id string) string {
+	if len(store.config.CredentialsIDKey) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, store.config.CredentialsIDKey)
+	_, _ = mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeIP converts the IP to its canonical form, so that equivalent IPv6
+// addresses are stored under the same key. IPv4-mapped IPv6 addresses are
+// converted to IPv4.
+func normalizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	} else if ipv4 := parsed.To4(); ipv4 != nil {
+		return ipv4.String()
+	}
+	return parsed.String()
+}
+
 func (store *containerStore) listContainers() ([]dockerClient.APIContainers, error) {
 	log.Debug("Listing containers")
 	var containers []dockerClient.APIContainers
@@ -244,15 +828,31 @@ func withRetries(lambda func() error) error {
 	return err
 }
 
+type containerAddress struct {
+	network string
+	ip      string
+}
+
 type containerConfig struct {
-	id      string
-	ips     []string
-	iamRole string
+	id            string
+	addresses     []containerAddress
+	gateways      map[string][]string
+	iamRole       *iam.Role
+	credentialsID string
+	metadata      map[string]string
+}
+
+type policyDocument struct {
+	Version   string
+	Statement json.RawMessage
 }
 
 type containerStore struct {
-	mutex               sync.RWMutex
-	containerIDsByIP    map[string]string
-	configByContainerID map[string]containerConfig
-	client              RawClient
+	mutex                       sync.RWMutex
+	containerIDsByIP            map[string]map[string]string
+	networksByGateway           map[string]map[string]bool
+	containerIDsByCredentialsID map[string]string
+	configByContainerID         map[string]containerConfig
+	client                      RawClient
+	config                      *Config
 }
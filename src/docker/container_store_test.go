@@ -6,7 +6,13 @@ import (
 	. "github.com/onsi/gomega"
 	. "github.com/swipely/iam-docker/src/docker"
 	"github.com/swipely/iam-docker/src/mock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"text/template"
+	"time"
 )
 
 var _ = Describe("ContainerStore", func() {
@@ -17,7 +23,7 @@ var _ = Describe("ContainerStore", func() {
 
 	BeforeEach(func() {
 		client = mock.NewDockerClient()
-		subject = NewContainerStore(client)
+		subject = NewContainerStore(client, &Config{})
 	})
 
 	Describe("AddContainerByID", func() {
@@ -46,7 +52,7 @@ var _ = Describe("ContainerStore", func() {
 				err := subject.AddContainerByID(id)
 				Expect(err).ToNot(BeNil())
 				role, err := subject.IAMRoleForID(id)
-				Expect(role).To(Equal(""))
+				Expect(role).To(BeNil())
 				Expect(err).ToNot(BeNil())
 			})
 		})
@@ -78,7 +84,7 @@ var _ = Describe("ContainerStore", func() {
 					err := subject.AddContainerByID(id)
 					Expect(err).ToNot(BeNil())
 					role, err := subject.IAMRoleForID(id)
-					Expect(role).To(Equal(""))
+					Expect(role).To(BeNil())
 					Expect(err).ToNot(BeNil())
 				})
 			})
@@ -105,12 +111,675 @@ var _ = Describe("ContainerStore", func() {
 					err := subject.AddContainerByID(id)
 					Expect(err).To(BeNil())
 					actual, err := subject.IAMRoleForID(id)
-					Expect(actual).To(Equal(role))
+					Expect(actual.ARN).To(Equal(role))
 					Expect(err).To(BeNil())
 				})
 			})
 		})
 
+		Context("And it uses the host's network", func() {
+			const (
+				role = "arn:aws:iam::012345678901:role/test"
+			)
+
+			BeforeEach(func() {
+				err := client.AddContainer(&dockerClient.Container{
+					ID: id,
+					Config: &dockerClient.Config{
+						Labels: map[string]string{"com.swipely.iam-docker.iam-profile": role},
+					},
+					HostConfig: &dockerClient.HostConfig{NetworkMode: "host"},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"host": dockerClient.ContainerNetwork{},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			It("Adds the container to the store", func() {
+				err := subject.AddContainerByID(id)
+				Expect(err).To(BeNil())
+				actual, err := subject.IAMRoleForID(id)
+				Expect(actual.ARN).To(Equal(role))
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Context("And it requests a session duration", func() {
+			const (
+				role = "arn:aws:iam::012345678901:role/batch"
+			)
+
+			var (
+				duration string
+			)
+
+			JustBeforeEach(func() {
+				err := client.AddContainer(&dockerClient.Container{
+					ID: id,
+					Config: &dockerClient.Config{
+						Labels: map[string]string{
+							"com.swipely.iam-docker.iam-profile":      role,
+							"com.swipely.iam-docker.session-duration": duration,
+						},
+					},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			Context("As a duration", func() {
+				BeforeEach(func() {
+					duration = "12h"
+				})
+
+				It("Adds the duration to the role", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.ARN).To(Equal(role))
+					Expect(actual.Duration).To(Equal(12 * time.Hour))
+				})
+			})
+
+			Context("In seconds", func() {
+				BeforeEach(func() {
+					duration = "7200"
+				})
+
+				It("Adds the duration to the role", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.Duration).To(Equal(2 * time.Hour))
+				})
+			})
+
+			Context("Outside of the range allowed by STS", func() {
+				BeforeEach(func() {
+					duration = "13h"
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+					_, err = subject.IAMRoleForID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("Which is invalid", func() {
+				BeforeEach(func() {
+					duration = "forever"
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+		})
+
+		Context("And it has an external ID", func() {
+			const (
+				role = "arn:aws:iam::210987654321:role/vendor"
+			)
+
+			BeforeEach(func() {
+				err := client.AddContainer(&dockerClient.Container{
+					ID: id,
+					Config: &dockerClient.Config{
+						Labels: map[string]string{
+							"com.swipely.iam-docker.iam-profile": role,
+							"com.swipely.iam-docker.external-id": "c0ffee",
+						},
+					},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			It("Adds the external ID to the role", func() {
+				err := subject.AddContainerByID(id)
+				Expect(err).To(BeNil())
+				actual, err := subject.IAMRoleForID(id)
+				Expect(err).To(BeNil())
+				Expect(actual.ARN).To(Equal(role))
+				Expect(actual.ExternalID).To(Equal("c0ffee"))
+			})
+		})
+
+		Context("And session tags are derived from its labels", func() {
+			const (
+				role = "arn:aws:iam::012345678901:role/abac"
+			)
+
+			var (
+				team string
+			)
+
+			BeforeEach(func() {
+				team = "payments"
+				subject = NewContainerStore(client, &Config{
+					TagLabels: map[string]string{
+						"com.example.team":    "team",
+						"com.example.service": "service",
+						"com.example.env":     "env",
+					},
+					TransitiveTagKeys: []string{"team", "service"},
+				})
+			})
+
+			JustBeforeEach(func() {
+				err := client.AddContainer(&dockerClient.Container{
+					ID: id,
+					Config: &dockerClient.Config{
+						Labels: map[string]string{
+							"com.swipely.iam-docker.iam-profile": role,
+							"com.example.team":                   team,
+							"com.example.env":                    "production",
+							"com.example.unrelated":              "ignored",
+						},
+					},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			It("Adds the tags to the role", func() {
+				err := subject.AddContainerByID(id)
+				Expect(err).To(BeNil())
+				actual, err := subject.IAMRoleForID(id)
+				Expect(err).To(BeNil())
+				Expect(actual.Tags).To(Equal(map[string]string{"team": "payments", "env": "production"}))
+				Expect(actual.TransitiveTagKeys).To(Equal([]string{"team"}))
+			})
+
+			Context("But a tag value is invalid", func() {
+				BeforeEach(func() {
+					team = "payments|search"
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+					_, err = subject.IAMRoleForID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+		})
+
+		Context("And it has a session policy", func() {
+			const (
+				role = "arn:aws:iam::012345678901:role/platform"
+			)
+
+			var (
+				labels map[string]string
+				dir    string
+			)
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "policies")
+				Expect(err).To(BeNil())
+				policy := "{\n  \"Version\": \"2012-10-17\",\n  \"Statement\": []\n}\n"
+				Expect(ioutil.WriteFile(filepath.Join(dir, "reader.json"), []byte(policy), 0600)).To(BeNil())
+				subject = NewContainerStore(client, &Config{PolicyDir: dir})
+				labels = map[string]string{"com.swipely.iam-docker.iam-profile": role}
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			JustBeforeEach(func() {
+				err := client.AddContainer(&dockerClient.Container{
+					ID:     id,
+					Config: &dockerClient.Config{Labels: labels},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			Context("Inline", func() {
+				BeforeEach(func() {
+					labels["com.swipely.iam-docker.session-policy"] = `{ "Version": "2012-10-17", "Statement": [] }`
+				})
+
+				It("Adds the compacted policy to the role", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.Policy).To(Equal(`{"Version":"2012-10-17","Statement":[]}`))
+				})
+			})
+
+			Context("In a file", func() {
+				BeforeEach(func() {
+					labels["com.swipely.iam-docker.session-policy-file"] = "reader.json"
+				})
+
+				It("Adds the compacted policy to the role", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.Policy).To(Equal(`{"Version":"2012-10-17","Statement":[]}`))
+				})
+			})
+
+			Context("In a file outside of the policy directory", func() {
+				BeforeEach(func() {
+					labels["com.swipely.iam-docker.session-policy-file"] = "../reader.json"
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("Which is not valid JSON", func() {
+				BeforeEach(func() {
+					labels["com.swipely.iam-docker.session-policy"] = `{"Version": "2012-10-17",`
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+					_, err = subject.IAMRoleForID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			for _, invalid := range []string{`"42"`, `[]`, `null`, `{"Version": "2012-10-17"}`, `{"Statement": []}`, `{"Version": "2012-10-17", "Statement": "Allow"}`} {
+				policy := invalid
+				Context("Which is not a policy document: "+policy, func() {
+					BeforeEach(func() {
+						labels["com.swipely.iam-docker.session-policy"] = policy
+					})
+
+					It("Does not add the container to the store", func() {
+						err := subject.AddContainerByID(id)
+						Expect(err).ToNot(BeNil())
+					})
+				})
+			}
+
+			Context("Which is longer than 2048 characters once compacted", func() {
+				BeforeEach(func() {
+					resource := strings.Repeat("x", 2048)
+					labels["com.swipely.iam-docker.session-policy"] = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "` + resource + `"}]}`
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("As managed policy ARNs", func() {
+				BeforeEach(func() {
+					labels["com.swipely.iam-docker.session-policy-arns"] = "arn:aws:iam::aws:policy/ReadOnlyAccess, arn:aws:iam::012345678901:policy/Reports"
+				})
+
+				It("Adds the sorted ARNs to the role", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.PolicyARNs).To(Equal([]string{
+						"arn:aws:iam::012345678901:policy/Reports",
+						"arn:aws:iam::aws:policy/ReadOnlyAccess",
+					}))
+				})
+			})
+
+			Context("As an invalid managed policy ARN", func() {
+				BeforeEach(func() {
+					labels["com.swipely.iam-docker.session-policy-arns"] = "arn:aws:iam::012345678901:role/Reports"
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(id)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+		})
+
+		Context("And session names are rendered from a template", func() {
+			const (
+				longID = "DEADBEEFCAFEF00D0123456789"
+				role   = "arn:aws:iam::012345678901:role/test"
+			)
+
+			var (
+				sessionName    string
+				sourceIdentity string
+			)
+
+			BeforeEach(func() {
+				sessionName = "{{.Name}}@{{.Host}}"
+				sourceIdentity = "{{.Image}}/{{.ID}}"
+			})
+
+			JustBeforeEach(func() {
+				subject = NewContainerStore(client, &Config{
+					SessionNameTemplate:    template.Must(template.New("session-name").Parse(sessionName)),
+					SourceIdentityTemplate: template.Must(template.New("source-identity").Parse(sourceIdentity)),
+					Hostname:               "worker-1",
+				})
+				err := client.AddContainer(&dockerClient.Container{
+					ID:   longID,
+					Name: "/billing_web.1",
+					Config: &dockerClient.Config{
+						Image:  "registry.example.com/billing:v42",
+						Labels: map[string]string{"com.swipely.iam-docker.iam-profile": role},
+					},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+			})
+
+			It("Sanitizes the rendered names", func() {
+				err := subject.AddContainerByID(longID)
+				Expect(err).To(BeNil())
+				actual, err := subject.IAMRoleForID(longID)
+				Expect(err).To(BeNil())
+				Expect(actual.SessionName).To(Equal("billing_web.1@worker-1"))
+				Expect(actual.SourceIdentity).To(Equal("registry.example.com-billing-v42-DEADBEEFCAFE"))
+			})
+
+			Context("When the rendered name is too long", func() {
+				BeforeEach(func() {
+					sessionName = "{{.Image}}{{.Image}}{{.Image}}"
+				})
+
+				It("Truncates it", func() {
+					err := subject.AddContainerByID(longID)
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(longID)
+					Expect(err).To(BeNil())
+					Expect(actual.SessionName).To(HaveLen(64))
+				})
+			})
+
+			Context("When the template refers to an unknown field", func() {
+				BeforeEach(func() {
+					sessionName = "{{.Team}}"
+				})
+
+				It("Does not add the container to the store", func() {
+					err := subject.AddContainerByID(longID)
+					Expect(err).ToNot(BeNil())
+				})
+			})
+		})
+
+		Context("And it has a role chain", func() {
+			const (
+				role = "arn:aws:iam::222222222222:role/production"
+			)
+
+			var (
+				chain string
+			)
+
+			JustBeforeEach(func() {
+				err := client.AddContainer(&dockerClient.Container{
+					ID: id,
+					Config: &dockerClient.Config{
+						Labels: map[string]string{
+							"com.swipely.iam-docker.iam-profile": role,
+							"com.swipely.iam-docker.role-chain":  chain,
+						},
+					},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})
+				Expect(err).To(BeNil())
+				Expect(subject.AddContainerByID(id)).To(BeNil())
+			})
+
+			Context("Of intermediate roles", func() {
+				BeforeEach(func() {
+					chain = "arn:aws:iam::111111111111:role/broker, arn:aws:iam::222222222222:role/deployer"
+				})
+
+				It("Adds the chain to the role", func() {
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.Chain).To(Equal([]string{
+						"arn:aws:iam::111111111111:role/broker",
+						"arn:aws:iam::222222222222:role/deployer",
+					}))
+				})
+			})
+
+			Context("Which is empty", func() {
+				BeforeEach(func() {
+					chain = ""
+				})
+
+				It("Assumes the role directly", func() {
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.Chain).ToNot(BeNil())
+					Expect(actual.Chain).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("And its IAM role is given by name or ARN", func() {
+			var (
+				config *Config
+				label  string
+				chain  string
+				err    error
+			)
+
+			BeforeEach(func() {
+				config = &Config{DefaultAccount: "012345678901"}
+				chain = ""
+			})
+
+			JustBeforeEach(func() {
+				subject = NewContainerStore(client, config)
+				labels := map[string]string{"com.swipely.iam-docker.iam-profile": label}
+				if chain != "" {
+					labels["com.swipely.iam-docker.role-chain"] = chain
+				}
+				Expect(client.AddContainer(&dockerClient.Container{
+					ID:     id,
+					Config: &dockerClient.Config{Labels: labels},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress: ip,
+							},
+						},
+					},
+				})).To(BeNil())
+				err = subject.AddContainerByID(id)
+			})
+
+			Context("As a name", func() {
+				BeforeEach(func() {
+					label = "reader"
+				})
+
+				It("Resolves it against the default account", func() {
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.ARN).To(Equal("arn:aws:iam::012345678901:role/reader"))
+				})
+			})
+
+			Context("As a path and name", func() {
+				BeforeEach(func() {
+					label = "service-role/batch/reader"
+				})
+
+				It("Resolves it against the default account", func() {
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.ARN).To(Equal("arn:aws:iam::012345678901:role/service-role/batch/reader"))
+				})
+			})
+
+			Context("As a name in another partition", func() {
+				BeforeEach(func() {
+					config.DefaultPartition = "aws-cn"
+					label = "reader"
+				})
+
+				It("Resolves it against the default partition", func() {
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.ARN).To(Equal("arn:aws-cn:iam::012345678901:role/reader"))
+				})
+			})
+
+			Context("As a name without a default account", func() {
+				BeforeEach(func() {
+					config.DefaultAccount = ""
+					label = "reader"
+				})
+
+				It("Rejects the container", func() {
+					Expect(err).ToNot(BeNil())
+					Expect(err.Error()).To(ContainSubstring(id))
+					Expect(err.Error()).To(ContainSubstring("No default account"))
+				})
+			})
+
+			Context("As an invalid name", func() {
+				BeforeEach(func() {
+					label = "reader role"
+				})
+
+				It("Rejects the container", func() {
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("As an ARN in the aws-us-gov partition", func() {
+				BeforeEach(func() {
+					label = "arn:aws-us-gov:iam::210987654321:role/reader"
+				})
+
+				It("Keeps the ARN", func() {
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.ARN).To(Equal(label))
+				})
+			})
+
+			Context("As an ARN with a typo in its account ID", func() {
+				BeforeEach(func() {
+					label = "arn:aws:iam::01234567890:role/reader"
+				})
+
+				It("Rejects the container", func() {
+					Expect(err).ToNot(BeNil())
+					Expect(err.Error()).To(ContainSubstring(label))
+				})
+			})
+
+			Context("As an ARN in an unknown partition", func() {
+				BeforeEach(func() {
+					label = "arn:aws-xx:iam::012345678901:role/reader"
+				})
+
+				It("Rejects the container", func() {
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("As an ARN of something other than a role", func() {
+				BeforeEach(func() {
+					label = "arn:aws:iam::012345678901:user/reader"
+				})
+
+				It("Rejects the container", func() {
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("With a role chain of names", func() {
+				BeforeEach(func() {
+					label = "reader"
+					chain = "broker, arn:aws:iam::210987654321:role/deployer"
+				})
+
+				It("Resolves each intermediate role", func() {
+					Expect(err).To(BeNil())
+					actual, err := subject.IAMRoleForID(id)
+					Expect(err).To(BeNil())
+					Expect(actual.Chain).To(Equal([]string{
+						"arn:aws:iam::012345678901:role/broker",
+						"arn:aws:iam::210987654321:role/deployer",
+					}))
+				})
+			})
+
+			Context("With an invalid role chain", func() {
+				BeforeEach(func() {
+					label = "reader"
+					chain = "arn:aws:iam::broker"
+				})
+
+				It("Rejects the container", func() {
+					Expect(err).ToNot(BeNil())
+				})
+			})
+		})
+
 		Context("And it has an IAM role set via environment variable", func() {
 			const (
 				role = "arn:aws:iam::012345678901:role/test"
@@ -139,7 +808,7 @@ var _ = Describe("ContainerStore", func() {
 					err := subject.AddContainerByID(id)
 					Expect(err).ToNot(BeNil())
 					role, err := subject.IAMRoleForID(id)
-					Expect(role).To(Equal(""))
+					Expect(role).To(BeNil())
 					Expect(err).ToNot(BeNil())
 				})
 			})
@@ -167,7 +836,7 @@ var _ = Describe("ContainerStore", func() {
 					err := subject.AddContainerByID(id)
 					Expect(err).To(BeNil())
 					actual, err := subject.IAMRoleForID(id)
-					Expect(actual).To(Equal(role))
+					Expect(actual.ARN).To(Equal(role))
 					Expect(err).To(BeNil())
 				})
 			})
@@ -217,7 +886,10 @@ var _ = Describe("ContainerStore", func() {
 		})
 
 		It("Returns the IAM roles that are stored", func() {
-			actual := subject.IAMRoles()
+			actual := make([]string, 0, len(roles))
+			for _, role := range subject.IAMRoles() {
+				actual = append(actual, role.ARN)
+			}
 			sort.Strings(actual)
 			sort.Strings(roles)
 			Expect(actual).To(Equal(roles))
@@ -232,7 +904,7 @@ var _ = Describe("ContainerStore", func() {
 		Context("When the ID is not stored", func() {
 			It("Returns an error", func() {
 				actual, err := subject.IAMRoleForID(id)
-				Expect(actual).To(Equal(""))
+				Expect(actual).To(BeNil())
 				Expect(err).ToNot(BeNil())
 			})
 		})
@@ -259,7 +931,7 @@ var _ = Describe("ContainerStore", func() {
 
 			It("Returns the IAM role", func() {
 				actual, err := subject.IAMRoleForID(id)
-				Expect(actual).To(Equal(role))
+				Expect(actual.ARN).To(Equal(role))
 				Expect(err).To(BeNil())
 			})
 		})
@@ -276,10 +948,10 @@ var _ = Describe("ContainerStore", func() {
 		Context("When the IP is not stored", func() {
 			It("Returns an error", func() {
 				actual, err := subject.IAMRoleForIP(ipOne)
-				Expect(actual).To(Equal(""))
+				Expect(actual).To(BeNil())
 				Expect(err).ToNot(BeNil())
 				actual, err = subject.IAMRoleForIP(ipTwo)
-				Expect(actual).To(Equal(""))
+				Expect(actual).To(BeNil())
 				Expect(err).ToNot(BeNil())
 			})
 		})
@@ -305,12 +977,262 @@ var _ = Describe("ContainerStore", func() {
 
 			It("Returns the IAM role", func() {
 				actual, err := subject.IAMRoleForIP(ipOne)
-				Expect(actual).To(Equal(role))
+				Expect(actual.ARN).To(Equal(role))
 				Expect(err).To(BeNil())
 				actual, err = subject.IAMRoleForIP(ipTwo)
-				Expect(actual).To(Equal(role))
+				Expect(actual.ARN).To(Equal(role))
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Context("When the IPv6 address is stored", func() {
+			BeforeEach(func() {
+				_ = client.AddContainer(&dockerClient.Container{
+					ID:     id,
+					Config: &dockerClient.Config{Labels: map[string]string{"com.swipely.iam-docker.iam-profile": role}},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"bridge": dockerClient.ContainerNetwork{
+								IPAddress:         "172.0.0.99",
+								GlobalIPv6Address: "2001:DB8:0:0::0242:AC11:2",
+							},
+						},
+					},
+				})
+				_ = subject.SyncRunningContainers()
+			})
+
+			It("Returns the IAM role for either address", func() {
+				actual, err := subject.IAMRoleForIP("2001:db8::242:ac11:2")
+				Expect(actual.ARN).To(Equal(role))
+				Expect(err).To(BeNil())
+				actual, err = subject.IAMRoleForIP("::ffff:172.0.0.99")
+				Expect(actual.ARN).To(Equal(role))
+				Expect(err).To(BeNil())
+			})
+		})
+	})
+
+	Describe("IAMRoleForCredentialsID", func() {
+		const (
+			id      = "5EC2E7ED"
+			otherID = "0DDBA11"
+			role    = "arn:aws:iam::012345678901:role/ecs"
+		)
+
+		addContainer := func(containerID string, ip string) {
+			_ = client.AddContainer(&dockerClient.Container{
+				ID: containerID,
+				Config: &dockerClient.Config{
+					Labels: map[string]string{"com.swipely.iam-docker.iam-profile": role},
+					Env:    []string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI=/v2/credentials/chosen-by-container"},
+				},
+				NetworkSettings: &dockerClient.NetworkSettings{
+					Networks: map[string]dockerClient.ContainerNetwork{
+						"bridge": dockerClient.ContainerNetwork{
+							IPAddress: ip,
+						},
+					},
+				},
+			})
+		}
+
+		Context("When there is no credentials ID key", func() {
+			BeforeEach(func() {
+				addContainer(id, "172.0.0.2")
+				_ = subject.SyncRunningContainers()
+			})
+
+			It("Does not assign a credentials ID", func() {
+				credentialsID, err := subject.CredentialsIDForID(id)
+				Expect(credentialsID).To(Equal(""))
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		Context("When there is a credentials ID key", func() {
+			var (
+				key = []byte("0123456789abcdef0123456789abcdef")
+			)
+
+			BeforeEach(func() {
+				subject = NewContainerStore(client, &Config{CredentialsIDKey: key})
+				addContainer(id, "172.0.0.2")
+				addContainer(otherID, "172.0.0.3")
+				_ = subject.SyncRunningContainers()
+			})
+
+			It("Returns the IAM role of the container's credentials ID", func() {
+				credentialsID, err := subject.CredentialsIDForID(id)
+				Expect(err).To(BeNil())
+				Expect(credentialsID).To(HaveLen(64))
+				actual, err := subject.IAMRoleForCredentialsID(credentialsID)
+				Expect(err).To(BeNil())
+				Expect(actual.ARN).To(Equal(role))
+			})
+
+			It("Does not let the container choose its credentials ID", func() {
+				actual, err := subject.IAMRoleForCredentialsID("chosen-by-container")
+				Expect(actual).To(BeNil())
+				Expect(err).ToNot(BeNil())
+			})
+
+			It("Assigns each container its own credentials ID", func() {
+				credentialsID, _ := subject.CredentialsIDForID(id)
+				otherCredentialsID, _ := subject.CredentialsIDForID(otherID)
+				Expect(otherCredentialsID).ToNot(Equal(credentialsID))
+				actual, err := subject.IAMRoleForID(otherID)
+				Expect(err).To(BeNil())
+				Expect(actual.ARN).To(Equal(role))
+			})
+
+			It("Keeps the credentials ID when the containers are synced again", func() {
+				credentialsID, _ := subject.CredentialsIDForID(id)
+				_ = subject.SyncRunningContainers()
+				Expect(subject.CredentialsIDForID(id)).To(Equal(credentialsID))
+			})
+
+			It("Assigns a different credentials ID with a different key", func() {
+				credentialsID, _ := subject.CredentialsIDForID(id)
+				other := NewContainerStore(client, &Config{CredentialsIDKey: []byte("another key")})
+				_ = other.SyncRunningContainers()
+				Expect(other.CredentialsIDForID(id)).ToNot(Equal(credentialsID))
+			})
+
+			It("Forgets the credentials ID when the container is removed", func() {
+				credentialsID, _ := subject.CredentialsIDForID(id)
+				subject.RemoveContainer(id)
+				actual, err := subject.IAMRoleForCredentialsID(credentialsID)
+				Expect(actual).To(BeNil())
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+
+	Describe("ContainerIDForAddress", func() {
+		const (
+			ip = "10.0.0.5"
+		)
+
+		BeforeEach(func() {
+			_ = client.AddContainer(&dockerClient.Container{
+				ID:     "A1FA",
+				Config: &dockerClient.Config{Labels: map[string]string{"com.swipely.iam-docker.iam-profile": "arn:aws:iam::012345678901:role/alpha"}},
+				NetworkSettings: &dockerClient.NetworkSettings{
+					Networks: map[string]dockerClient.ContainerNetwork{
+						"alpha": dockerClient.ContainerNetwork{
+							NetworkID: "a1fa",
+							IPAddress: ip,
+							Gateway:   "10.0.0.1",
+						},
+					},
+				},
+			})
+			_ = client.AddContainer(&dockerClient.Container{
+				ID:     "BE7A",
+				Config: &dockerClient.Config{Labels: map[string]string{"com.swipely.iam-docker.iam-profile": "arn:aws:iam::012345678901:role/beta"}},
+				NetworkSettings: &dockerClient.NetworkSettings{
+					Networks: map[string]dockerClient.ContainerNetwork{
+						"beta": dockerClient.ContainerNetwork{
+							NetworkID: "be7a",
+							IPAddress: ip,
+							Gateway:   "10.0.0.2",
+						},
+					},
+				},
+			})
+			_ = subject.SyncRunningContainers()
+		})
+
+		Context("When the request was received on a network's gateway", func() {
+			It("Returns the container on that network", func() {
+				actual, err := subject.ContainerIDForAddress("10.0.0.1", ip)
+				Expect(actual).To(Equal("A1FA"))
+				Expect(err).To(BeNil())
+				actual, err = subject.ContainerIDForAddress("10.0.0.2", ip)
+				Expect(actual).To(Equal("BE7A"))
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Context("When the network cannot be determined", func() {
+			It("Returns an error", func() {
+				actual, err := subject.ContainerIDForAddress("127.0.0.1", ip)
+				Expect(actual).To(Equal(""))
+				Expect(err).ToNot(BeNil())
+				role, err := subject.IAMRoleForIP(ip)
+				Expect(role).To(BeNil())
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		Context("When no container has the IP on the gateway's network", func() {
+			BeforeEach(func() {
+				subject.RemoveContainer("BE7A")
+			})
+
+			It("Returns an error", func() {
+				actual, err := subject.ContainerIDForAddress("10.0.0.2", ip)
+				Expect(actual).To(Equal(""))
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		Context("When another container registers the same address", func() {
+			BeforeEach(func() {
+				_ = client.AddContainer(&dockerClient.Container{
+					ID:     "C0FFEE",
+					Config: &dockerClient.Config{Labels: map[string]string{"com.swipely.iam-docker.iam-profile": "arn:aws:iam::012345678901:role/admin"}},
+					NetworkSettings: &dockerClient.NetworkSettings{
+						Networks: map[string]dockerClient.ContainerNetwork{
+							"alpha": dockerClient.ContainerNetwork{
+								NetworkID: "a1fa",
+								IPAddress: ip,
+								Gateway:   "10.0.0.1",
+							},
+						},
+					},
+				})
+			})
+
+			It("Refuses the registration", func() {
+				err := subject.AddContainerByID("C0FFEE")
+				Expect(err).ToNot(BeNil())
+				actual, err := subject.ContainerIDForAddress("10.0.0.1", ip)
+				Expect(actual).To(Equal("A1FA"))
 				Expect(err).To(BeNil())
 			})
+
+			Context("But the container which registered it has stopped", func() {
+				BeforeEach(func() {
+					_ = client.StopContainer("A1FA")
+				})
+
+				It("Replaces that container", func() {
+					err := subject.AddContainerByID("C0FFEE")
+					Expect(err).To(BeNil())
+					actual, err := subject.ContainerIDForAddress("10.0.0.1", ip)
+					Expect(actual).To(Equal("C0FFEE"))
+					Expect(err).To(BeNil())
+					role, err := subject.IAMRoleForID("A1FA")
+					Expect(role).To(BeNil())
+					Expect(err).ToNot(BeNil())
+				})
+			})
+
+			Context("But the container which registered it is gone", func() {
+				BeforeEach(func() {
+					_ = client.RemoveContainer("A1FA")
+				})
+
+				It("Replaces that container", func() {
+					err := subject.AddContainerByID("C0FFEE")
+					Expect(err).To(BeNil())
+					actual, err := subject.ContainerIDForAddress("10.0.0.1", ip)
+					Expect(actual).To(Equal("C0FFEE"))
+					Expect(err).To(BeNil())
+				})
+			})
 		})
 	})
 
@@ -324,11 +1246,11 @@ var _ = Describe("ContainerStore", func() {
 		Context("When the ID is not stored", func() {
 			It("Does not change the store", func() {
 				actual, err := subject.IAMRoleForID(id)
-				Expect(actual).To(Equal(""))
+				Expect(actual).To(BeNil())
 				Expect(err).ToNot(BeNil())
 				subject.RemoveContainer(id)
 				actual, err = subject.IAMRoleForID(id)
-				Expect(actual).To(Equal(""))
+				Expect(actual).To(BeNil())
 				Expect(err).ToNot(BeNil())
 			})
 		})
@@ -351,11 +1273,11 @@ var _ = Describe("ContainerStore", func() {
 
 			It("Removes the container", func() {
 				actual, err := subject.IAMRoleForID(id)
-				Expect(actual).To(Equal(role))
+				Expect(actual.ARN).To(Equal(role))
 				Expect(err).To(BeNil())
 				subject.RemoveContainer(id)
 				actual, err = subject.IAMRoleForID(id)
-				Expect(actual).To(Equal(""))
+				Expect(actual).To(BeNil())
 				Expect(err).ToNot(BeNil())
 			})
 		})
@@ -402,13 +1324,39 @@ var _ = Describe("ContainerStore", func() {
 			err := subject.SyncRunningContainers()
 			Expect(err).To(BeNil())
 			role, err := subject.IAMRoleForIP("172.0.0.15")
-			Expect(role).To(Equal("arn:aws:iam::012345678901:role/reader"))
+			Expect(role.ARN).To(Equal("arn:aws:iam::012345678901:role/reader"))
 			Expect(err).To(BeNil())
 			role, err = subject.IAMRoleForIP("172.0.0.16")
-			Expect(role).To(Equal("arn:aws:iam::012345678901:role/writer"))
+			Expect(role.ARN).To(Equal("arn:aws:iam::012345678901:role/writer"))
 			Expect(err).To(BeNil())
 			role, err = subject.IAMRoleForIP("172.0.0.17")
-			Expect(role).To(Equal(""))
+			Expect(role).To(BeNil())
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("ResolveRoleARN", func() {
+		config := &Config{DefaultAccount: "012345678901", DefaultPartition: "aws-cn"}
+
+		It("Returns valid ARNs as is", func() {
+			arn, err := ResolveRoleARN(" arn:aws:iam::210987654321:role/broker ", config)
+			Expect(err).To(BeNil())
+			Expect(arn).To(Equal("arn:aws:iam::210987654321:role/broker"))
+		})
+
+		It("Resolves role names in the default account and partition", func() {
+			arn, err := ResolveRoleARN("ops/broker", config)
+			Expect(err).To(BeNil())
+			Expect(arn).To(Equal("arn:aws-cn:iam::012345678901:role/ops/broker"))
+		})
+
+		It("Rejects invalid ARNs", func() {
+			_, err := ResolveRoleARN("arn:aws:iam::0123:role/broker", config)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Rejects role names without a default account", func() {
+			_, err := ResolveRoleARN("broker", &Config{})
 			Expect(err).ToNot(BeNil())
 		})
 	})
@@ -58,7 +58,7 @@ func (handler *eventHandler) work(workerID int, channel <-chan *dockerClient.API
 				elog.WithField("error", err.Error()).Warn("Unable to lookup IAM role")
 				continue
 			}
-			rlog := elog.WithFields(logrus.Fields{"role": role})
+			rlog := elog.WithFields(logrus.Fields{"role": role.ARN})
 			rlog.Info("Fetching credentials")
 			_, err = handler.credentialStore.CredentialsForRole(role)
 			if err != nil {
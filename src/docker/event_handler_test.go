@@ -27,8 +27,8 @@ var _ = Describe("EventHandler", func() {
 		channel = make(chan *docker.APIEvents)
 		dockerClient = mock.NewDockerClient()
 		stsClient = mock.NewSTSClient()
-		containerStore = NewContainerStore(dockerClient)
-		credentialStore = iam.NewCredentialStore(stsClient, 1)
+		containerStore = NewContainerStore(dockerClient, &Config{})
+		credentialStore = iam.NewCredentialStore(stsClient, 1, &iam.Config{})
 		subject = NewEventHandler(1, containerStore, credentialStore)
 		_ = dockerClient.AddEventListener(channel)
 		waitGroup.Add(1)
@@ -72,7 +72,7 @@ var _ = Describe("EventHandler", func() {
 
 			Context("When the container has com.swipely.iam-docker.iam-profile set", func() {
 				var (
-					role            = "test-role"
+					role            = "arn:aws:iam::012345678901:role/test-role"
 					accessKeyID     = "test-access-key-id"
 					secretAccessKey = "test-secret-access-key"
 					expiration      = time.Now().Add(time.Hour)
@@ -135,7 +135,7 @@ var _ = Describe("EventHandler", func() {
 
 			Context("When the container is in the store", func() {
 				var (
-					role            = "test-role"
+					role            = "arn:aws:iam::012345678901:role/test-role"
 					accessKeyID     = "test-access-key-id"
 					secretAccessKey = "test-secret-access-key"
 					expiration      = time.Now().Add(time.Hour)
@@ -164,7 +164,7 @@ var _ = Describe("EventHandler", func() {
 					waitGroup.Wait()
 					_, err := containerStore.IAMRoleForID(id)
 					Expect(err).ToNot(BeNil())
-					creds, err := credentialStore.CredentialsForRole(role)
+					creds, err := credentialStore.CredentialsForRole(&iam.Role{ARN: role})
 					Expect(err).To(BeNil())
 					Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
 				})
@@ -3,6 +3,8 @@ package docker
 import (
 	"github.com/Sirupsen/logrus"
 	dockerClient "github.com/fsouza/go-dockerclient"
+	iam "github.com/swipely/iam-docker/src/iam"
+	"text/template"
 )
 
 var (
@@ -13,13 +15,58 @@ var (
 // Instances of this interface should allow threadsafe reads and writes.
 type ContainerStore interface {
 	AddContainerByID(id string) error
-	IAMRoles() []string
-	IAMRoleForIP(ip string) (string, error)
-	IAMRoleForID(ip string) (string, error)
+	IAMRoles() []*iam.Role
+	IAMRoleForIP(ip string) (*iam.Role, error)
+	IAMRoleForID(ip string) (*iam.Role, error)
+	IAMRoleForCredentialsID(credentialsID string) (*iam.Role, error)
+	CredentialsIDForID(id string) (string, error)
+	ContainerIDForAddress(localIP string, remoteIP string) (string, error)
+	MetadataForID(id string) (map[string]string, error)
 	RemoveContainer(name string)
 	SyncRunningContainers() error
 }
 
+// Config holds the configuration of the ContainerStore.
+type Config struct {
+	// TagLabels are the container labels which are passed as session tags,
+	// mapped to the key of their tag.
+	TagLabels map[string]string
+	// TransitiveTagKeys are the keys of the session tags which persist when
+	// the session assumes another role.
+	TransitiveTagKeys []string
+	// PolicyDir is the directory of session policy files which containers may
+	// reference by name. When empty, policy files may not be referenced.
+	PolicyDir string
+	// SessionNameTemplate renders the session name of the container's role
+	// from its SessionAttributes. When nil, session names are random and
+	// containers with the same role share credentials.
+	SessionNameTemplate *template.Template
+	// SourceIdentityTemplate renders the source identity of the container's
+	// role from its SessionAttributes. When nil, no source identity is set.
+	SourceIdentityTemplate *template.Template
+	// Hostname is the name of the host, which may be used by the templates.
+	Hostname string
+	// DefaultAccount is the account ID of roles which containers give by name
+	// rather than ARN. When empty, containers must give full ARNs.
+	DefaultAccount string
+	// DefaultPartition is the partition of roles which containers give by
+	// name. When empty, it's "aws".
+	DefaultPartition string
+	// CredentialsIDKey is the key from which the ECS credentials ID of each
+	// container is derived. When empty, containers have no credentials ID.
+	CredentialsIDKey []byte
+}
+
+// SessionAttributes describe the container to the session name and source
+// identity templates.
+type SessionAttributes struct {
+	// ID is the short container ID.
+	ID    string
+	Name  string
+	Image string
+	Host  string
+}
+
 // EventHandler instances implement DockerEventsChannel() which performs actions
 // based on Docker events. Listen() is a blocking function which performs an
 // action based on the events written to the channel.
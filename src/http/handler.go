@@ -1,15 +1,23 @@
 package http
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/swipely/iam-docker/src/docker"
 	"github.com/swipely/iam-docker/src/iam"
+	"github.com/swipely/iam-docker/src/metadata"
+	"github.com/swipely/iam-docker/src/proc"
 	"github.com/valyala/fasthttp"
 	adaptor "github.com/valyala/fasthttp/fasthttpadaptor"
 )
@@ -18,7 +26,15 @@ const (
 	iamMethod      = "GET"
 	credentialType = "AWS-HMAC"
 	credentialCode = "Success"
-	iamPath        = "/meta-data/iam/security-credentials"
+	ecsPath        = "/v2/credentials/"
+	tokenMethod    = "PUT"
+	tokenHeader    = "X-aws-ec2-metadata-token"
+	tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	forwardHeader  = "X-Forwarded-For"
+	minTokenTTL    = 1
+	maxTokenTTL    = 21600
+	profileIDChars = 17
+	localIPv4Path  = "meta-data/local-ipv4"
 )
 
 var (
@@ -28,13 +44,19 @@ var (
 // NewIAMHandler creates a http.Handler which responds to metadata API requests.
 // When the request is for the IAM path, it looks up the IAM role in the
 // container store and fetches those credentials. Otherwise, it acts as a
-// reverse proxy for the real API.
-func NewIAMHandler(upstream http.Handler, containerStore docker.ContainerStore, credentialStore iam.CredentialStore, disableUpstream bool) fasthttp.RequestHandler {
+// reverse proxy for the real API. IMDSv2 session tokens are issued and
+// validated by the handler itself, and are never forwarded upstream. When
+// enabled, the ECS container credentials endpoint is served as well.
+func NewIAMHandler(upstream http.Handler, containerStore docker.ContainerStore, credentialStore iam.CredentialStore, config *Config) fasthttp.RequestHandler {
 	handler := &httpHandler{
 		upstreamHandler: adaptor.NewFastHTTPHandler(upstream),
 		containerStore:  containerStore,
 		credentialStore: credentialStore,
-		disableUpstream: disableUpstream,
+		tokenStore:      newTokenStore(),
+		upstreamPolicy:  newUpstreamPolicy(config),
+		requireToken:    config.RequireToken,
+		ecsCredentials:  config.ECSCredentials,
+		resolver:        config.HostNetworkResolver,
 	}
 
 	return handler.serveFastHTTP
@@ -43,63 +65,134 @@ func NewIAMHandler(upstream http.Handler, containerStore docker.ContainerStore,
 func (handler *httpHandler) serveFastHTTP(ctx *fasthttp.RequestCtx) {
 	path := string(ctx.Path())
 	method := string(ctx.Method())
-	addr := ctx.RemoteAddr().String()
+	addr := clientAddress{
+		local:      clientIP(ctx.LocalAddr().String()),
+		remote:     clientIP(ctx.RemoteAddr().String()),
+		remoteAddr: ctx.RemoteAddr(),
+	}
+
+	route, param := routeRequest(path)
+	if ((route == ecsRoute) || (route == ecsURIRoute)) && !handler.ecsCredentials {
+		route = upstreamRoute
+	}
+
+	logPath := path
+	if route == ecsRoute {
+		// Don't log the credentials ID, since it grants access to credentials.
+		logPath = ecsPath
+	}
 
 	logger := log.WithFields(logrus.Fields{
-		"path":       path,
+		"path":       logPath,
 		"method":     method,
-		"remoteAddr": addr,
+		"remoteAddr": ctx.RemoteAddr().String(),
+		"localAddr":  ctx.LocalAddr().String(),
 	})
 
-	if method == iamMethod {
-		idx := strings.LastIndex(path, iamPath)
-		if idx == (len(path)-len(iamPath)) || (idx == (len(path)-len(iamPath))-1 && path[len(path)-1] == '/') {
-			logger.Debug("Serving list IAM credentials request")
-			handler.serveListCredentialsRequest(ctx, addr, logger)
+	switch route {
+	case ecsRoute:
+		if method != iamMethod {
+			logger.Info("Denying container credentials request with invalid method")
+			ctx.SetStatusCode(http.StatusMethodNotAllowed)
 			return
-		} else if idx >= 1 {
-			logger.Info("Serving IAM credentials request")
-			handler.serveIAMRequest(ctx, addr, path, logger)
+		}
+		logger.Info("Serving container credentials request")
+		handler.serveECSRequest(ctx, param, logger)
+		return
+	case ecsURIRoute:
+		if method != iamMethod {
+			logger.Info("Denying container credentials URI request with invalid method")
+			ctx.SetStatusCode(http.StatusMethodNotAllowed)
 			return
-		} else if handler.disableUpstream {
-			logger.Info("Denying non-IAM endpoint request")
-			handler.serveDeniedRequest(ctx, addr, path, logger)
+		}
+		logger.Debug("Serving container credentials URI request")
+		handler.serveECSURIRequest(ctx, addr, logger)
+		return
+	case tokenRoute:
+		if method != tokenMethod {
+			logger.Info("Denying session token request with invalid method")
+			ctx.SetStatusCode(http.StatusMethodNotAllowed)
 			return
 		}
-	} else if handler.disableUpstream {
-		logger.Info("Denying non-IAM endpoint request")
-		handler.serveDeniedRequest(ctx, addr, path, logger)
+		logger.Debug("Serving session token request")
+		handler.serveTokenRequest(ctx, addr, logger)
 		return
 	}
 
-	logger.Debug("Delegating request upstream")
-	handler.upstreamHandler(ctx)
+	if !handler.authorizeRequest(ctx, addr, logger) {
+		ctx.SetStatusCode(http.StatusUnauthorized)
+		return
+	}
+
+	if (route != upstreamRoute) && (route != metadataRoute) && (method != iamMethod) {
+		logger.Info("Denying IAM endpoint request with invalid method")
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch route {
+	case iamListRoute:
+		logger.Debug("Serving list IAM request")
+		handler.serveListIAMRequest(ctx, logger)
+	case iamInfoRoute:
+		logger.Debug("Serving IAM info request")
+		handler.serveInfoRequest(ctx, addr, logger)
+	case credentialsListRoute:
+		logger.Debug("Serving list IAM credentials request")
+		handler.serveListCredentialsRequest(ctx, addr, logger)
+	case credentialsRoute:
+		logger.Info("Serving IAM credentials request")
+		handler.serveIAMRequest(ctx, addr, param, logger)
+	case notFoundRoute:
+		logger.Info("Unknown IAM endpoint request")
+		serveNotFound(ctx)
+	case metadataRoute:
+		if (method == iamMethod) && handler.serveContainerMetadata(ctx, addr, param, logger) {
+			return
+		}
+		fallthrough
+	default:
+		permitted, rule := handler.upstreamPolicy.permits(path)
+		rlog := logger.WithField("rule", rule)
+		if !permitted {
+			rlog.Info("Denying upstream request")
+			handler.serveDeniedRequest(ctx, addr, path, rlog)
+			return
+		}
+		// Forward the normalized path which was checked against the policy,
+		// rather than the raw request URI, along with the query.
+		uri := path
+		if query := ctx.URI().QueryString(); len(query) > 0 {
+			uri += "?" + string(query)
+		}
+		ctx.Request.SetRequestURI(uri)
+		rlog.Debug("Delegating request upstream")
+		handler.upstreamHandler(ctx)
+	}
 }
 
-func (handler *httpHandler) serveIAMRequest(ctx *fasthttp.RequestCtx, addr string, path string, logger *logrus.Entry) {
+func (handler *httpHandler) serveIAMRequest(ctx *fasthttp.RequestCtx, addr clientAddress, requestedRole string, logger *logrus.Entry) {
 	role, creds, err := handler.credentialsForAddress(addr)
 	if err != nil {
 		logger.WithField("error", err.Error()).Warn("Unable to find credentials")
-		ctx.SetStatusCode(http.StatusNotFound)
+		serveNotFound(ctx)
 		return
 	}
-	idx := strings.LastIndex(path, "/")
-	requestedRole := path[idx+1:]
-	if !strings.HasSuffix(*role, requestedRole) {
+	if roleName(role.ARN) != requestedRole {
 		logger.WithFields(logrus.Fields{
-			"actual-role":    *role,
+			"actual-role":    role.ARN,
 			"requested-role": requestedRole,
 		}).Warn("Role mismatch")
-		ctx.SetStatusCode(http.StatusUnauthorized)
+		serveNotFound(ctx)
 		return
 	}
 	response, err := json.Marshal(&CredentialResponse{
 		AccessKeyID:     *creds.AccessKeyId,
 		Code:            credentialCode,
 		Expiration:      *creds.Expiration,
-		LastUpdated:     creds.Expiration.Add(-1 * time.Hour),
+		LastUpdated:     creds.LastUpdated,
 		SecretAccessKey: *creds.SecretAccessKey,
-		Token:           *creds.SessionToken,
+		Token:           aws.StringValue(creds.SessionToken),
 		Type:            credentialType,
 	})
 	if err != nil {
@@ -107,30 +200,210 @@ func (handler *httpHandler) serveIAMRequest(ctx *fasthttp.RequestCtx, addr strin
 		ctx.SetStatusCode(http.StatusInternalServerError)
 		return
 	}
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody(response)
+	logger.Debug("Successfully responded")
+}
+
+func (handler *httpHandler) serveECSRequest(ctx *fasthttp.RequestCtx, credentialsID string, logger *logrus.Entry) {
+	role, err := handler.containerStore.IAMRoleForCredentialsID(credentialsID)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to find container")
+		ctx.SetStatusCode(http.StatusNotFound)
+		return
+	}
+	creds, err := handler.credentialStore.CredentialsForRole(role)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"role":  role.ARN,
+			"error": err.Error(),
+		}).Warn("Unable to find credentials")
+		ctx.SetStatusCode(http.StatusNotFound)
+		return
+	}
+	response, err := json.Marshal(&ContainerCredentialResponse{
+		AccessKeyID:     *creds.AccessKeyId,
+		Expiration:      *creds.Expiration,
+		RoleArn:         role.ARN,
+		SecretAccessKey: *creds.SecretAccessKey,
+		Token:           aws.StringValue(creds.SessionToken),
+	})
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to serialize JSON")
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(response)
+	logger.Debug("Successfully responded")
+}
+
+// serveECSURIRequest responds with the relative URI of the container's ECS
+// credentials, which the container identified by the request's address may
+// set as AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+func (handler *httpHandler) serveECSURIRequest(ctx *fasthttp.RequestCtx, addr clientAddress, logger *logrus.Entry) {
+	id, err := handler.containerIDForAddress(addr)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to find container")
+		ctx.SetStatusCode(http.StatusNotFound)
+		return
+	}
+	credentialsID, err := handler.containerStore.CredentialsIDForID(id)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to find credentials ID")
+		ctx.SetStatusCode(http.StatusNotFound)
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("text/plain")
+	ctx.SetBodyString(ecsPath + credentialsID)
+	logger.WithField("id", id).Debug("Successfully responded")
+}
+
+func (handler *httpHandler) serveInfoRequest(ctx *fasthttp.RequestCtx, addr clientAddress, logger *logrus.Entry) {
+	role, creds, err := handler.credentialsForAddress(addr)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to find credentials")
+		serveNotFound(ctx)
+		return
+	}
+	profileARN, err := instanceProfileARN(role.ARN)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to determine instance profile")
+		serveNotFound(ctx)
+		return
+	}
+	response, err := json.Marshal(&InfoResponse{
+		Code:               credentialCode,
+		LastUpdated:        creds.LastUpdated,
+		InstanceProfileArn: profileARN,
+		InstanceProfileID:  instanceProfileID(profileARN),
+	})
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to serialize JSON")
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
 	ctx.SetBody(response)
 	logger.Debug("Successfully responded")
 }
 
-func (handler *httpHandler) serveListCredentialsRequest(ctx *fasthttp.RequestCtx, addr string, logger *logrus.Entry) {
+func (handler *httpHandler) serveListCredentialsRequest(ctx *fasthttp.RequestCtx, addr clientAddress, logger *logrus.Entry) {
 	role, _, err := handler.credentialsForAddress(addr)
 	if err != nil {
 		logger.WithField("error", err.Error()).Warn("Unable to find credentials")
-		ctx.SetStatusCode(http.StatusNotFound)
+		serveNotFound(ctx)
 		return
 	}
-	idx := strings.LastIndex(*role, "/")
-	ctx.SetBodyString((*role)[idx+1:])
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("text/plain")
+	ctx.SetBodyString(roleName(role.ARN))
+	logger.Debug("Successfully responded")
+}
+
+func (handler *httpHandler) serveListIAMRequest(ctx *fasthttp.RequestCtx, logger *logrus.Entry) {
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("text/plain")
+	ctx.SetBodyString(infoSegment + "\n" + credentialsSegment + "/")
 	logger.Debug("Successfully responded")
 }
 
-func (handler *httpHandler) serveDeniedRequest(ctx *fasthttp.RequestCtx, addr string, path string, logger *logrus.Entry) {
-	ctx.SetStatusCode(403)
+// serveContainerMetadata answers the request from the container's own
+// metadata, such as its name and IP or a value set by label. It returns false
+// when the request should fall back to the upstream instead.
+func (handler *httpHandler) serveContainerMetadata(ctx *fasthttp.RequestCtx, addr clientAddress, metadataPath string, logger *logrus.Entry) bool {
+	id, err := handler.containerIDForAddress(addr)
+	if err != nil {
+		return false
+	}
+	metadata, err := handler.containerStore.MetadataForID(id)
+	if err != nil {
+		return false
+	}
+	value, hasKey := metadata[metadataPath]
+	if !hasKey && (metadataPath == localIPv4Path) && (net.ParseIP(addr.remote).To4() != nil) {
+		value, hasKey = addr.remote, true
+	}
+	if !hasKey {
+		return false
+	}
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetContentType("text/plain")
+	ctx.SetBodyString(value)
+	logger.WithField("id", id).Debug("Served container metadata")
+	return true
+}
+
+func (handler *httpHandler) serveTokenRequest(ctx *fasthttp.RequestCtx, addr clientAddress, logger *logrus.Entry) {
+	if _, hasHeader := peekHeader(ctx, forwardHeader); hasHeader {
+		logger.Warn("Denying forwarded session token request")
+		ctx.SetStatusCode(http.StatusForbidden)
+		return
+	}
+	value, _ := peekHeader(ctx, tokenTTLHeader)
+	ttl, err := strconv.Atoi(value)
+	if (err != nil) || (ttl < minTokenTTL) || (ttl > maxTokenTTL) {
+		logger.WithField("ttl", value).Info("Invalid session token TTL")
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+	token, err := handler.tokenStore.issue(handler.tokenClient(addr), time.Duration(ttl)*time.Second)
+	if err != nil {
+		logger.WithField("error", err.Error()).Warn("Unable to generate session token")
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.Response.Header.Set(tokenTTLHeader, value)
+	ctx.SetContentType("text/plain")
+	ctx.SetBodyString(token)
+	logger.Debug("Successfully responded")
+}
+
+// authorizeRequest checks the session token of the request, if any. Requests
+// without a token are only authorized when tokens are optional (IMDSv1). The
+// token header is removed so that it isn't forwarded upstream.
+func (handler *httpHandler) authorizeRequest(ctx *fasthttp.RequestCtx, addr clientAddress, logger *logrus.Entry) bool {
+	token, hasHeader := peekHeader(ctx, tokenHeader)
+	if !hasHeader {
+		if handler.requireToken {
+			logger.Info("Denying request without a session token")
+			return false
+		}
+		return true
+	}
+	deleteHeader(ctx, tokenHeader)
+	if !handler.tokenStore.validate(token, handler.tokenClient(addr)) {
+		logger.Info("Denying request with an invalid session token")
+		return false
+	}
+	return true
+}
+
+// tokenClient identifies the client which session tokens are bound to, by
+// both its address and its container. Containers which share an address, such
+// as those using the host's network, can't use each other's tokens.
+func (handler *httpHandler) tokenClient(addr clientAddress) string {
+	id, err := handler.containerIDForAddress(addr)
+	if err != nil {
+		return addr.String()
+	}
+	return addr.String() + "/" + id
+}
+
+func (handler *httpHandler) serveDeniedRequest(ctx *fasthttp.RequestCtx, addr clientAddress, path string, logger *logrus.Entry) {
+	serveNotFound(ctx)
 	logger.Debug("Successfully responded")
 }
 
-func (handler *httpHandler) credentialsForAddress(address string) (*string, *sts.Credentials, error) {
-	ip := strings.Split(address, ":")[0]
-	role, err := handler.containerStore.IAMRoleForIP(ip)
+func (handler *httpHandler) credentialsForAddress(addr clientAddress) (*iam.Role, *iam.Credentials, error) {
+	id, err := handler.containerIDForAddress(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	role, err := handler.containerStore.IAMRoleForID(id)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -138,12 +411,114 @@ func (handler *httpHandler) credentialsForAddress(address string) (*string, *sts
 	if err != nil {
 		return nil, nil, err
 	}
-	return &role, creds, nil
+	return role, creds, nil
+}
+
+// instanceProfileARN synthesizes the ARN of an instance profile which has the
+// same account, path, and name as the given role.
+func instanceProfileARN(role string) (string, error) {
+	idx := strings.Index(role, ":role/")
+	if idx < 0 {
+		return "", fmt.Errorf("Not a role ARN: %s", role)
+	}
+	return role[:idx] + ":instance-profile/" + role[idx+len(":role/"):], nil
+}
+
+// instanceProfileID derives a stable, unique ID in the format of an instance
+// profile ID from the instance profile ARN.
+func instanceProfileID(profileARN string) string {
+	sum := sha256.Sum256([]byte(profileARN))
+	return "AIPA" + base32.StdEncoding.EncodeToString(sum[:])[:profileIDChars]
+}
+
+// containerIDForAddress identifies the container which sent the request by its
+// network and IP. When that fails and host networking is enabled, the
+// container which owns the client's socket is looked up instead.
+func (handler *httpHandler) containerIDForAddress(addr clientAddress) (string, error) {
+	id, err := handler.containerStore.ContainerIDForAddress(addr.local, addr.remote)
+	if (err == nil) || (handler.resolver == nil) {
+		return id, err
+	}
+	tcpAddr, ok := addr.remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return "", err
+	}
+	hostID, hostErr := handler.resolver.ContainerIDForConnection(tcpAddr)
+	if hostErr != nil {
+		return "", fmt.Errorf("%s; %s", err.Error(), hostErr.Error())
+	}
+	return hostID, nil
+}
+
+// serveNotFound responds with the same 404 page as the EC2 metadata API.
+func serveNotFound(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(http.StatusNotFound)
+	ctx.SetContentType("text/html")
+	ctx.SetBodyString(metadata.NotFoundBody)
+}
+
+// clientIP extracts the IP from a remote address, which may be IPv4
+// (`ip:port`) or IPv6 (`[ip]:port`). IPv4-mapped IPv6 addresses are returned
+// as IPv4.
+func clientIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	} else if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.String()
+	}
+	return ip.String()
+}
+
+// peekHeader looks up a request header case-insensitively, since header names
+// are not normalized by the server.
+func peekHeader(ctx *fasthttp.RequestCtx, name string) (string, bool) {
+	var value string
+	found := false
+	ctx.Request.Header.VisitAll(func(key []byte, val []byte) {
+		if !found && bytes.EqualFold(key, []byte(name)) {
+			value = string(val)
+			found = true
+		}
+	})
+	return value, found
+}
+
+func deleteHeader(ctx *fasthttp.RequestCtx, name string) {
+	keys := make([]string, 0, 1)
+	ctx.Request.Header.VisitAll(func(key []byte, val []byte) {
+		if bytes.EqualFold(key, []byte(name)) {
+			keys = append(keys, string(key))
+		}
+	})
+	for _, key := range keys {
+		ctx.Request.Header.Del(key)
+	}
+}
+
+// clientAddress identifies the sender of a request by its IP and the local IP
+// on which the request was received, which determines the Docker network.
+type clientAddress struct {
+	local      string
+	remote     string
+	remoteAddr net.Addr
+}
+
+func (addr clientAddress) String() string {
+	return addr.local + "/" + addr.remote
 }
 
 type httpHandler struct {
 	upstreamHandler fasthttp.RequestHandler
 	containerStore  docker.ContainerStore
 	credentialStore iam.CredentialStore
-	disableUpstream bool
+	tokenStore      *tokenStore
+	upstreamPolicy  *upstreamPolicy
+	requireToken    bool
+	ecsCredentials  bool
+	resolver        proc.ContainerResolver
 }
@@ -0,0 +1,555 @@
+package http_test
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/sts"
+	dockerClient "github.com/fsouza/go-dockerclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/swipely/iam-docker/src/docker"
+	. "github.com/swipely/iam-docker/src/http"
+	"github.com/swipely/iam-docker/src/iam"
+	"github.com/swipely/iam-docker/src/mock"
+	"github.com/valyala/fasthttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("IAMHandler", func() {
+	const (
+		id       = "DEADBEEF"
+		ip       = "172.17.0.2"
+		ipv6     = "2001:db8::242:ac11:2"
+		role     = "arn:aws:iam::012345678901:role/test"
+		hostID   = "4A1B2C3D"
+		hostIP   = "10.0.0.1"
+		hostRole = "arn:aws:iam::012345678901:role/host"
+	)
+
+	var (
+		accessKeyID     = "fakeaccesskeyid"
+		secretAccessKey = "fakesecretaccesskey"
+		sessionToken    = "fakesessiontoken"
+		token           *string
+		config          *Config
+		credentialsID   string
+		lifetime        time.Duration
+		remoteIP        string
+		remotePort      int
+		subject         fasthttp.RequestHandler
+	)
+
+	request := func(method string, path string, headers map[string]string) *fasthttp.RequestCtx {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(method)
+		req.SetRequestURI(path)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(remoteIP), Port: remotePort}, nil)
+		subject(ctx)
+		return ctx
+	}
+
+	BeforeEach(func() {
+		config = &Config{}
+		lifetime = time.Hour
+		remoteIP = ip
+		remotePort = 4567
+		token = &sessionToken
+	})
+
+	JustBeforeEach(func() {
+		client := mock.NewDockerClient()
+		_ = client.AddContainer(&dockerClient.Container{
+			ID:   id,
+			Name: "/web",
+			Config: &dockerClient.Config{
+				Labels: map[string]string{
+					"com.swipely.iam-docker.iam-profile":           role,
+					"com.swipely.iam-docker.meta.placement/region": "us-west-2",
+				},
+			},
+			NetworkSettings: &dockerClient.NetworkSettings{
+				Networks: map[string]dockerClient.ContainerNetwork{
+					"bridge": dockerClient.ContainerNetwork{
+						IPAddress:         ip,
+						GlobalIPv6Address: ipv6,
+					},
+				},
+			},
+		})
+		_ = client.AddContainer(&dockerClient.Container{
+			ID:         hostID,
+			Config:     &dockerClient.Config{Labels: map[string]string{"com.swipely.iam-docker.iam-profile": hostRole}},
+			HostConfig: &dockerClient.HostConfig{NetworkMode: "host"},
+			NetworkSettings: &dockerClient.NetworkSettings{
+				Networks: map[string]dockerClient.ContainerNetwork{
+					"host": dockerClient.ContainerNetwork{},
+				},
+			},
+		})
+		containerStore := docker.NewContainerStore(client, &docker.Config{CredentialsIDKey: []byte("credentials ID key")})
+		_ = containerStore.SyncRunningContainers()
+		credentialsID, _ = containerStore.CredentialsIDForID(id)
+
+		stsClient := mock.NewSTSClient()
+		expiration := time.Now().Add(lifetime)
+		stsClient.AssumableRoles[role] = &sts.Credentials{
+			AccessKeyId:     &accessKeyID,
+			SecretAccessKey: &secretAccessKey,
+			SessionToken:    token,
+			Expiration:      &expiration,
+		}
+		stsClient.AssumableRoles[hostRole] = stsClient.AssumableRoles[role]
+		credentialStore := iam.NewCredentialStore(stsClient, 1, &iam.Config{})
+
+		upstream := mock.NewHandler(func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/latest/meta-data/instance-id" {
+				_, _ = writer.Write([]byte("upstream:" + request.Header.Get("X-aws-ec2-metadata-token")))
+			} else if request.URL.RawQuery != "" {
+				_, _ = writer.Write([]byte("upstream:" + request.URL.Path + "?" + request.URL.RawQuery))
+			} else {
+				_, _ = writer.Write([]byte("upstream:" + request.URL.Path))
+			}
+		})
+		subject = NewIAMHandler(upstream, containerStore, credentialStore, config)
+	})
+
+	Describe("Session tokens", func() {
+		Context("When the TTL header is missing", func() {
+			It("Responds with a bad request", func() {
+				ctx := request("PUT", "/latest/api/token", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("When the TTL is out of range", func() {
+			It("Responds with a bad request", func() {
+				ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21601"})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("When the request is forwarded", func() {
+			It("Responds with forbidden", func() {
+				ctx := request("PUT", "/latest/api/token", map[string]string{
+					"X-aws-ec2-metadata-token-ttl-seconds": "60",
+					"X-Forwarded-For":                      "10.0.0.1",
+				})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusForbidden))
+			})
+		})
+
+		Context("When a valid token is presented", func() {
+			It("Serves the credentials", func() {
+				ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Header.Peek("X-aws-ec2-metadata-token-ttl-seconds"))).To(Equal("60"))
+				token := string(ctx.Response.Body())
+				Expect(token).ToNot(BeEmpty())
+
+				ctx = request("GET", "/latest/meta-data/iam/security-credentials/test", map[string]string{"X-aws-ec2-metadata-token": token})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				var response CredentialResponse
+				Expect(json.Unmarshal(ctx.Response.Body(), &response)).To(BeNil())
+				Expect(response.AccessKeyID).To(Equal(accessKeyID))
+			})
+
+			It("Does not forward the token upstream", func() {
+				ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+				token := string(ctx.Response.Body())
+
+				ctx = request("GET", "/latest/meta-data/instance-id", map[string]string{"X-aws-ec2-metadata-token": token})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:"))
+			})
+		})
+
+		Context("When an invalid token is presented", func() {
+			It("Responds with unauthorized", func() {
+				ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", map[string]string{"X-aws-ec2-metadata-token": "bogus"})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusUnauthorized))
+			})
+		})
+
+		Context("When an expired token is presented", func() {
+			It("Responds with unauthorized", func() {
+				ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "1"})
+				token := string(ctx.Response.Body())
+				time.Sleep(1100 * time.Millisecond)
+				ctx = request("GET", "/latest/meta-data/iam/security-credentials/test", map[string]string{"X-aws-ec2-metadata-token": token})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusUnauthorized))
+			})
+		})
+
+		Context("When an altered token is presented", func() {
+			It("Responds with unauthorized", func() {
+				ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+				token := []byte(ctx.Response.Body())
+				if token[10] == 'A' {
+					token[10] = 'B'
+				} else {
+					token[10] = 'A'
+				}
+				ctx = request("GET", "/latest/meta-data/iam/security-credentials/test", map[string]string{"X-aws-ec2-metadata-token": string(token)})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusUnauthorized))
+			})
+		})
+
+		Context("When no token is presented", func() {
+			Context("And tokens are optional", func() {
+				It("Serves the credentials", func() {
+					ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				})
+			})
+
+			Context("And tokens are required", func() {
+				BeforeEach(func() {
+					config.RequireToken = true
+				})
+
+				It("Responds with unauthorized", func() {
+					ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusUnauthorized))
+				})
+			})
+		})
+	})
+
+	Describe("Container credentials", func() {
+		Context("When the endpoint is disabled", func() {
+			It("Delegates the request upstream", func() {
+				ctx := request("GET", "/v2/credentials/"+credentialsID, nil)
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:/v2/credentials/" + credentialsID))
+			})
+
+			It("Delegates the credentials URI request upstream", func() {
+				ctx := request("GET", "/v2/credentials", nil)
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:/v2/credentials"))
+			})
+		})
+
+		Context("When the endpoint is enabled", func() {
+			BeforeEach(func() {
+				config.ECSCredentials = true
+			})
+
+			Context("And the credentials ID is unknown", func() {
+				It("Responds with not found", func() {
+					ctx := request("GET", "/v2/credentials/bogus", nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				})
+			})
+
+			Context("And the container asks for its credentials URI", func() {
+				It("Serves the relative URI of its credentials", func() {
+					ctx := request("GET", "/v2/credentials", nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+					Expect(credentialsID).ToNot(BeEmpty())
+					Expect(string(ctx.Response.Body())).To(Equal("/v2/credentials/" + credentialsID))
+				})
+
+				It("Responds with not found to unknown containers", func() {
+					remoteIP = "172.17.0.99"
+					ctx := request("GET", "/v2/credentials/", nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				})
+			})
+
+			Context("And the credentials ID is known", func() {
+				It("Serves the credentials", func() {
+					ctx := request("GET", "/v2/credentials/"+credentialsID, nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+					var response ContainerCredentialResponse
+					Expect(json.Unmarshal(ctx.Response.Body(), &response)).To(BeNil())
+					Expect(response.AccessKeyID).To(Equal(accessKeyID))
+					Expect(response.SecretAccessKey).To(Equal(secretAccessKey))
+					Expect(response.Token).To(Equal(sessionToken))
+					Expect(response.RoleArn).To(Equal(role))
+				})
+			})
+		})
+	})
+
+	Describe("Credentials without a session token", func() {
+		BeforeEach(func() {
+			token = nil
+			config.ECSCredentials = true
+		})
+
+		It("Serves them with an empty token", func() {
+			ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", nil)
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+			var response CredentialResponse
+			Expect(json.Unmarshal(ctx.Response.Body(), &response)).To(BeNil())
+			Expect(response.AccessKeyID).To(Equal(accessKeyID))
+			Expect(response.Token).To(BeEmpty())
+
+			ctx = request("GET", "/v2/credentials/"+credentialsID, nil)
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+			var ecsResponse ContainerCredentialResponse
+			Expect(json.Unmarshal(ctx.Response.Body(), &ecsResponse)).To(BeNil())
+			Expect(ecsResponse.AccessKeyID).To(Equal(accessKeyID))
+			Expect(ecsResponse.Token).To(BeEmpty())
+		})
+	})
+
+	Describe("IAM info", func() {
+		It("Serves the instance profile of the container's role", func() {
+			ctx := request("GET", "/latest/meta-data/iam/info", nil)
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+			var response InfoResponse
+			Expect(json.Unmarshal(ctx.Response.Body(), &response)).To(BeNil())
+			Expect(response.Code).To(Equal("Success"))
+			Expect(response.InstanceProfileArn).To(Equal("arn:aws:iam::012345678901:instance-profile/test"))
+			Expect(response.InstanceProfileID).To(HavePrefix("AIPA"))
+			Expect(response.InstanceProfileID).To(HaveLen(21))
+		})
+	})
+
+	Describe("Credential timestamps", func() {
+		BeforeEach(func() {
+			lifetime = 12 * time.Hour
+		})
+
+		It("Serves when the credentials were issued", func() {
+			before := time.Now()
+			ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", nil)
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+			var response CredentialResponse
+			Expect(json.Unmarshal(ctx.Response.Body(), &response)).To(BeNil())
+			Expect(response.LastUpdated).To(BeTemporally(">=", before.Truncate(time.Second)))
+			Expect(response.LastUpdated).To(BeTemporally("<=", time.Now()))
+			Expect(response.Expiration.Sub(response.LastUpdated)).To(BeNumerically(">", 11*time.Hour))
+		})
+	})
+
+	Describe("Routing", func() {
+		Context("When the credentials are requested by an exact role name", func() {
+			It("Serves the credentials", func() {
+				for _, version := range []string{"latest", "2016-09-02", "1.0"} {
+					ctx := request("GET", "/"+version+"/meta-data/iam/security-credentials/test", nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				}
+			})
+		})
+
+		Context("When the credentials are requested by a suffix of the role name", func() {
+			It("Responds with not found", func() {
+				ctx := request("GET", "/latest/meta-data/iam/security-credentials/est", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				Expect(string(ctx.Response.Body())).To(ContainSubstring("404 - Not Found"))
+			})
+		})
+
+		Context("When the credentials are listed", func() {
+			It("Serves the role name with or without a trailing slash", func() {
+				for _, path := range []string{"/latest/meta-data/iam/security-credentials", "/latest/meta-data/iam/security-credentials/"} {
+					ctx := request("GET", path, nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+					Expect(string(ctx.Response.Body())).To(Equal("test"))
+				}
+			})
+		})
+
+		Context("When the IAM directory is listed", func() {
+			It("Serves its entries", func() {
+				ctx := request("GET", "/latest/meta-data/iam/", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Body())).To(Equal("info\nsecurity-credentials/"))
+			})
+		})
+
+		Context("When an unknown IAM path is requested", func() {
+			It("Responds with not found", func() {
+				for _, path := range []string{"/latest/meta-data/iam/bogus", "/latest/meta-data/iam/info/", "/latest/meta-data/iam/security-credentials/test/extra"} {
+					ctx := request("GET", path, nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				}
+			})
+		})
+
+		Context("When the IAM tree is requested below another version", func() {
+			It("Serves it rather than delegating it upstream", func() {
+				ctx := request("GET", "/1.0/meta-data/iam/info", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Body())).To(ContainSubstring("instance-profile/test"))
+				ctx = request("GET", "/1.0/meta-data/iam/security-credentials/", nil)
+				Expect(string(ctx.Response.Body())).To(Equal("test"))
+				ctx = request("GET", "/bogus/meta-data/iam/security-credentials/other", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("When another path does not begin with an API version", func() {
+			It("Delegates the request upstream", func() {
+				ctx := request("GET", "/bogus/meta-data/instance-id", nil)
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:/bogus/meta-data/instance-id"))
+			})
+		})
+	})
+
+	Describe("IPv6", func() {
+		BeforeEach(func() {
+			remoteIP = ipv6
+		})
+
+		It("Serves the credentials of the container with that address", func() {
+			ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", nil)
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+		})
+
+		It("Binds session tokens to that address", func() {
+			ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+			token := string(ctx.Response.Body())
+			ctx = request("GET", "/latest/meta-data/iam/security-credentials/test", map[string]string{"X-aws-ec2-metadata-token": token})
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+
+			remoteIP = ip
+			ctx = request("GET", "/latest/meta-data/iam/security-credentials/test", map[string]string{"X-aws-ec2-metadata-token": token})
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("Host networking", func() {
+		BeforeEach(func() {
+			remoteIP = hostIP
+		})
+
+		Context("When host networking is not identified", func() {
+			It("Responds with not found", func() {
+				ctx := request("GET", "/latest/meta-data/iam/security-credentials/", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("When host networking is identified", func() {
+			var (
+				resolver *mock.ContainerResolver
+			)
+
+			BeforeEach(func() {
+				resolver = mock.NewContainerResolver()
+				resolver.ContainerIDsByClient[hostIP+":4567"] = hostID
+				config.HostNetworkResolver = resolver
+			})
+
+			It("Serves the role of the container which owns the socket", func() {
+				ctx := request("GET", "/latest/meta-data/iam/security-credentials/", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Body())).To(Equal("host"))
+			})
+
+			It("Binds session tokens to that container", func() {
+				resolver.ContainerIDsByClient[hostIP+":4568"] = "0DDBA11"
+				ctx := request("PUT", "/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+				token := string(ctx.Response.Body())
+				ctx = request("GET", "/latest/meta-data/iam/security-credentials/", map[string]string{"X-aws-ec2-metadata-token": token})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+
+				remotePort = 4568
+				ctx = request("GET", "/latest/meta-data/iam/security-credentials/", map[string]string{"X-aws-ec2-metadata-token": token})
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusUnauthorized))
+			})
+		})
+	})
+
+	Describe("Upstream policy", func() {
+		Context("When upstream requests are disabled", func() {
+			BeforeEach(func() {
+				config.DisableUpstream = true
+			})
+
+			It("Responds with not found", func() {
+				ctx := request("GET", "/latest/meta-data/instance-id", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				Expect(string(ctx.Response.Body())).To(ContainSubstring("404 - Not Found"))
+			})
+
+			It("Still serves IAM requests", func() {
+				ctx := request("GET", "/latest/meta-data/iam/security-credentials/test", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("When paths are allowed", func() {
+			BeforeEach(func() {
+				config.UpstreamAllow = []string{"meta-data/placement/", "meta-data/instance-*"}
+			})
+
+			It("Delegates matching requests upstream", func() {
+				for _, path := range []string{"/latest/meta-data/placement/availability-zone", "/2016-09-02/meta-data/placement/", "/latest/meta-data/instance-type"} {
+					ctx := request("GET", path, nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				}
+			})
+
+			It("Denies other requests", func() {
+				for _, path := range []string{"/latest/user-data", "/latest/meta-data/placement/../../user-data", "/latest/meta-data/public-keys/"} {
+					ctx := request("GET", path, nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				}
+			})
+		})
+
+		Context("When paths are denied", func() {
+			BeforeEach(func() {
+				config.UpstreamDeny = []string{"user-data", "meta-data/public-keys/"}
+			})
+
+			It("Denies matching requests", func() {
+				for _, path := range []string{"/latest/user-data", "/latest/user-data/", "/1.0/user-data", "/unknown/user-data", "/latest/meta-data/public-keys/0/openssh-key"} {
+					ctx := request("GET", path, nil)
+					Expect(ctx.Response.StatusCode()).To(Equal(http.StatusNotFound))
+				}
+			})
+
+			It("Delegates other requests upstream", func() {
+				ctx := request("GET", "/latest/meta-data/ami-id", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:/latest/meta-data/ami-id"))
+			})
+
+			It("Delegates the query of the request upstream", func() {
+				ctx := request("GET", "/latest/dynamic/instance-identity/signature?format=raw", nil)
+				Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:/latest/dynamic/instance-identity/signature?format=raw"))
+			})
+		})
+	})
+
+	Describe("Container metadata", func() {
+		It("Serves the container's IP and name", func() {
+			ctx := request("GET", "/latest/meta-data/local-ipv4", nil)
+			Expect(string(ctx.Response.Body())).To(Equal(ip))
+			ctx = request("GET", "/latest/meta-data/hostname", nil)
+			Expect(string(ctx.Response.Body())).To(Equal("web"))
+		})
+
+		It("Serves the paths overridden by labels", func() {
+			ctx := request("GET", "/latest/meta-data/placement/region", nil)
+			Expect(ctx.Response.StatusCode()).To(Equal(http.StatusOK))
+			Expect(string(ctx.Response.Body())).To(Equal("us-west-2"))
+		})
+
+		It("Delegates other paths upstream", func() {
+			ctx := request("GET", "/latest/meta-data/placement/availability-zone", nil)
+			Expect(string(ctx.Response.Body())).To(Equal("upstream:/latest/meta-data/placement/availability-zone"))
+		})
+
+		Context("When the container is unknown", func() {
+			BeforeEach(func() {
+				remoteIP = "172.17.0.99"
+			})
+
+			It("Delegates the request upstream", func() {
+				ctx := request("GET", "/latest/meta-data/local-ipv4", nil)
+				Expect(string(ctx.Response.Body())).To(Equal("upstream:/latest/meta-data/local-ipv4"))
+			})
+		})
+	})
+})
@@ -0,0 +1,121 @@
+package http
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	latestVersion      = "latest"
+	metaDataSegment    = "meta-data"
+	iamSegment         = "iam"
+	infoSegment        = "info"
+	credentialsSegment = "security-credentials"
+	apiSegment         = "api"
+	tokenSegment       = "token"
+)
+
+const (
+	// upstreamRoute is any request which isn't served by the handler itself.
+	upstreamRoute route = iota
+	// notFoundRoute is a path in the IAM tree which does not exist.
+	notFoundRoute
+	tokenRoute
+	iamListRoute
+	iamInfoRoute
+	credentialsListRoute
+	credentialsRoute
+	ecsRoute
+	// ecsURIRoute tells the container the relative URI of its ECS container
+	// credentials.
+	ecsURIRoute
+	// metadataRoute is any other path below an API version, which may be
+	// answered from the container's own metadata before it's proxied upstream.
+	metadataRoute
+)
+
+var (
+	datedVersion = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+)
+
+// routeRequest determines how the request path should be served. When the
+// route has a parameter, such as the requested role name, ECS credentials ID,
+// or the metadata path below the API version, it is returned as well.
+//
+// Metadata paths must begin with `/latest` or a dated API version, except for
+// the IAM tree, which is served below any version, such as `/1.0`, so that no
+// version reaches the host's instance profile. Directories in the IAM tree may
+// be requested with or without a trailing slash, while leaves must not have
+// one.
+func routeRequest(path string) (route, string) {
+	if (path == ecsPath) || (path == strings.TrimSuffix(ecsPath, "/")) {
+		return ecsURIRoute, ""
+	} else if strings.HasPrefix(path, ecsPath) {
+		return ecsRoute, path[len(ecsPath):]
+	} else if !strings.HasPrefix(path, "/") {
+		return upstreamRoute, ""
+	}
+
+	segments := strings.Split(path[1:], "/")
+	version := segments[0]
+	isVersion := (version == latestVersion) || datedVersion.MatchString(version)
+	segments = segments[1:]
+
+	if (version == latestVersion) && (len(segments) == 2) && (segments[0] == apiSegment) && (segments[1] == tokenSegment) {
+		return tokenRoute, ""
+	} else if (len(segments) < 2) || (segments[0] != metaDataSegment) || (segments[1] != iamSegment) {
+		if !isVersion {
+			return upstreamRoute, ""
+		}
+		return metadataRoute, strings.Join(segments, "/")
+	}
+	segments = segments[2:]
+
+	if isDirectory(segments) {
+		return iamListRoute, ""
+	} else if segments[0] == infoSegment {
+		if len(segments) == 1 {
+			return iamInfoRoute, ""
+		}
+		return notFoundRoute, ""
+	} else if segments[0] != credentialsSegment {
+		return notFoundRoute, ""
+	}
+	segments = segments[1:]
+
+	if isDirectory(segments) {
+		return credentialsListRoute, ""
+	} else if (len(segments) == 1) && (segments[0] != "") {
+		return credentialsRoute, segments[0]
+	}
+
+	return notFoundRoute, ""
+}
+
+// relativePath strips the leading slash and API version from the path. The
+// first segment is always the version, such as `latest`, `1.0` or a date, and
+// is stripped whatever it is, so that paths below versions which aren't known
+// here are still matched by the upstream policy.
+func relativePath(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	idx := strings.Index(path, "/")
+	if idx < 0 {
+		return ""
+	}
+	return path[idx+1:]
+}
+
+// isDirectory returns true when the remaining path segments refer to the
+// directory itself, with or without a trailing slash.
+func isDirectory(segments []string) bool {
+	return (len(segments) == 0) || ((len(segments) == 1) && (segments[0] == ""))
+}
+
+// roleName returns the last path segment of the role ARN, which is the name
+// of the role.
+func roleName(role string) string {
+	idx := strings.LastIndex(role, "/")
+	return role[idx+1:]
+}
+
+type route int
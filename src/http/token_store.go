@@ -0,0 +1,68 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	tokenKeyBytes        = 32
+	tokenExpirationBytes = 8
+)
+
+// newTokenStore creates a store of session tokens which are signed with a
+// random key rather than kept in memory, so that clients which request many
+// tokens don't grow the store or slow down other clients.
+func newTokenStore() *tokenStore {
+	key := make([]byte, tokenKeyBytes)
+	_, err := rand.Read(key)
+	return &tokenStore{key: key, keyErr: err}
+}
+
+// issue generates a new session token which is only valid for the given client
+// until the TTL elapses. The token is the expiration, signed along with the
+// client.
+func (store *tokenStore) issue(client string, ttl time.Duration) (string, error) {
+	if store.keyErr != nil {
+		return "", fmt.Errorf("Unable to generate session token key: %s", store.keyErr.Error())
+	}
+	expiration := make([]byte, tokenExpirationBytes)
+	binary.BigEndian.PutUint64(expiration, uint64(time.Now().Add(ttl).UnixNano()))
+	token := append(expiration, store.sign(expiration, client)...)
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// validate returns true when the token was issued to the given client and has
+// not yet expired.
+func (store *tokenStore) validate(token string, client string) bool {
+	if store.keyErr != nil {
+		return false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if (err != nil) || (len(decoded) != tokenExpirationBytes+sha256.Size) {
+		return false
+	}
+	expiration := decoded[:tokenExpirationBytes]
+	if !hmac.Equal(decoded[tokenExpirationBytes:], store.sign(expiration, client)) {
+		return false
+	}
+	return time.Now().UnixNano() < int64(binary.BigEndian.Uint64(expiration))
+}
+
+// sign computes the signature of the token's expiration and client.
+func (store *tokenStore) sign(expiration []byte, client string) []byte {
+	mac := hmac.New(sha256.New, store.key)
+	mac.Write(expiration)
+	mac.Write([]byte(client))
+	return mac.Sum(nil)
+}
+
+type tokenStore struct {
+	key    []byte
+	keyErr error
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"github.com/swipely/iam-docker/src/proc"
 	"time"
 )
 
@@ -14,3 +15,39 @@ type CredentialResponse struct {
 	Token           string
 	Type            string
 }
+
+// InfoResponse is generated by the IAM info handler.
+type InfoResponse struct {
+	Code               string
+	LastUpdated        time.Time
+	InstanceProfileArn string
+	InstanceProfileID  string `json:"InstanceProfileId"`
+}
+
+// ContainerCredentialResponse is generated by the ECS container credentials
+// handler.
+type ContainerCredentialResponse struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	Expiration      time.Time
+	RoleArn         string
+	SecretAccessKey string
+	Token           string
+}
+
+// Config holds the configuration of the IAM handler.
+type Config struct {
+	// DisableUpstream denies all non-IAM requests instead of proxying them.
+	DisableUpstream bool
+	// UpstreamAllow is the list of path patterns which may be proxied. When
+	// empty, every path which isn't denied may be proxied.
+	UpstreamAllow []string
+	// UpstreamDeny is the list of path patterns which may never be proxied.
+	UpstreamDeny []string
+	// RequireToken rejects requests without an IMDSv2 session token.
+	RequireToken bool
+	// ECSCredentials serves the ECS container credentials endpoint.
+	ECSCredentials bool
+	// HostNetworkResolver identifies containers which use the host's network
+	// by the owner of their socket. When nil, they are not identified.
+	HostNetworkResolver proc.ContainerResolver
+}
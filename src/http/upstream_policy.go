@@ -0,0 +1,57 @@
+package http
+
+import (
+	"path"
+	"strings"
+)
+
+func newUpstreamPolicy(config *Config) *upstreamPolicy {
+	return &upstreamPolicy{
+		disabled: config.DisableUpstream,
+		allow:    config.UpstreamAllow,
+		deny:     config.UpstreamDeny,
+	}
+}
+
+// permits determines whether the request path may be proxied upstream, and
+// returns the rule which made that decision. Patterns are matched against the
+// path below the API version, e.g. `meta-data/placement/availability-zone`,
+// using path.Match. A pattern ending in `/` matches everything beneath that
+// directory. Deny patterns take precedence, and when there are allow patterns,
+// one of them must match.
+func (policy *upstreamPolicy) permits(requestPath string) (bool, string) {
+	if policy.disabled {
+		return false, "disable-upstream"
+	}
+
+	relative := relativePath(requestPath)
+	for _, pattern := range policy.deny {
+		if matchesPattern(pattern, relative) {
+			return false, "deny:" + pattern
+		}
+	}
+	if len(policy.allow) == 0 {
+		return true, "default"
+	}
+	for _, pattern := range policy.allow {
+		if matchesPattern(pattern, relative) {
+			return true, "allow:" + pattern
+		}
+	}
+	return false, "not-allowed"
+}
+
+func matchesPattern(pattern string, relative string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(relative+"/", pattern)
+	}
+	matched, err := path.Match(pattern, strings.TrimSuffix(relative, "/"))
+	return (err == nil) && matched
+}
+
+type upstreamPolicy struct {
+	disabled bool
+	allow    []string
+	deny     []string
+}
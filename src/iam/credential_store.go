@@ -3,8 +3,9 @@ package iam
 import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,6 +13,12 @@ import (
 const (
 	refreshGracePeriod  = time.Minute * 30
 	realTimeGracePeriod = time.Second * 10
+	defaultDuration     = time.Hour
+	minDuration         = time.Minute * 15
+	maxDuration         = time.Hour * 12
+	maxChainedDuration  = time.Hour
+	defaultSaveDelay    = time.Second
+	validationErrorCode = "ValidationError"
 )
 
 var (
@@ -20,79 +27,464 @@ var (
 
 // NewCredentialStore accepts an STSClient and creates a new cache for assumed
 // IAM credentials.
-func NewCredentialStore(client STSClient, seed int64) CredentialStore {
-	return &credentialStore{
-		client: client,
-		creds:  make(map[string]*sts.Credentials),
-		rng:    rand.New(rand.NewSource(seed)),
+func NewCredentialStore(client STSClient, seed int64, config *Config) CredentialStore {
+	return NewCredentialStoreFromSource(NewSTSSource(client, config.ChainedClient), seed, config)
+}
+
+// NewCredentialStoreFromSource creates a new cache for IAM credentials which are
+// issued by the given source.
+func NewCredentialStoreFromSource(source CredentialSource, seed int64, config *Config) CredentialStore {
+	store := &credentialStore{
+		source:       source,
+		config:       config,
+		creds:        make(map[string]*cachedCredentials),
+		lastUsed:     make(map[string]time.Time),
+		maxDurations: make(map[string]time.Duration),
+		pending:      make(map[string]*pendingRefresh),
+		failures:     newFailureTracker(config.MinFailureBackoff, config.MaxFailureBackoff),
+		scheduler:    newRefreshScheduler(),
+		rng:          rand.New(rand.NewSource(seed)),
 	}
+	if config.Cache != nil {
+		store.loadCache()
+	}
+	return store
 }
 
-func (store *credentialStore) CredentialsForRole(arn string) (*sts.Credentials, error) {
-	return store.refreshCredential(arn, realTimeGracePeriod)
+func (store *credentialStore) CredentialsForRole(role *Role) (*Credentials, error) {
+	store.credMutex.Lock()
+	store.touchRole(role, time.Now())
+	store.credMutex.Unlock()
+	return store.refreshCredential(role, realTimeGracePeriod)
 }
 
-func (store *credentialStore) RefreshCredentials() {
-	log.Info("Refreshing all IAM credentials")
-	store.credMutex.RLock()
-	arns := make([]string, len(store.creds))
-	count := 0
-	for arn := range store.creds {
-		arns[count] = arn
-		count++
-	}
-	store.credMutex.RUnlock()
+func (store *credentialStore) RunRefreshScheduler(stop <-chan struct{}) {
+	log.WithField("workers", store.config.RefreshWorkers).Info("Scheduling credential refreshes")
+	store.scheduler.run(stop, store.config.RefreshWorkers, store.runScheduledRefresh)
+	store.flushCache()
+	log.Info("Done scheduling credential refreshes")
+}
 
-	for _, arn := range arns {
-		_, err := store.refreshCredential(arn, refreshGracePeriod)
-		if err != nil {
+func (store *credentialStore) ReconcileRoles(roles []*Role) {
+	now := time.Now()
+	store.credMutex.Lock()
+	for _, role := range roles {
+		store.touchRole(role, now)
+	}
+	// Credentials which were stored after their role was evicted, such as by
+	// an in-flight refresh, start idling now.
+	for key := range store.creds {
+		if _, hasKey := store.lastUsed[key]; !hasKey {
+			store.lastUsed[key] = now
+		}
+	}
+	if store.config.IdleTimeout == 0 {
+		store.credMutex.Unlock()
+		return
+	}
+	evicted := make([]string, 0)
+	for key, lastUsed := range store.lastUsed {
+		if now.Sub(lastUsed) <= store.config.IdleTimeout {
+			continue
+		}
+		if cached, hasKey := store.creds[key]; hasKey {
 			log.WithFields(logrus.Fields{
-				"role":  arn,
-				"error": err.Error(),
-			}).Warn("Unable to refresh credential")
+				"arn":       cached.role.ARN,
+				"last-used": lastUsed.Format(time.RFC3339),
+			}).Info("Evicting unused credential")
 		}
+		delete(store.creds, key)
+		delete(store.lastUsed, key)
+		evicted = append(evicted, key)
+	}
+	store.credMutex.Unlock()
+
+	for _, key := range evicted {
+		store.failures.clear(key)
+	}
+	if len(evicted) > 0 {
+		store.saveCache()
 	}
-	log.Info("Done refreshing all IAM credentials")
 }
 
-func (store *credentialStore) refreshCredential(arn string, gracePeriod time.Duration) (*sts.Credentials, error) {
-	clog := log.WithField("arn", arn)
+func (store *credentialStore) Failures() []Failure {
+	return store.failures.list()
+}
+
+func (store *credentialStore) refreshCredential(requested *Role, gracePeriod time.Duration) (*Credentials, error) {
+	role := store.resolveRole(requested)
+	key := role.Key()
+	clog := log.WithField("arn", role.ARN)
 	clog.Debug("Checking for stale credential")
-	store.credMutex.RLock()
-	creds, hasKey := store.creds[arn]
-	store.credMutex.RUnlock()
+	creds, isFresh := store.cachedCredential(key, gracePeriod)
+	if isFresh {
+		clog.Debug("Credential is fresh")
+		return creds, nil
+	} else if creds != nil {
+		clog.Debug("Credential is stale, refreshing")
+	} else {
+		clog.Debug("Credential is not in the store")
+	}
 
-	if hasKey {
-		if time.Now().Add(gracePeriod).Before(*creds.Expiration) {
-			clog.Debug("Credential is fresh")
+	err := store.failures.check(key)
+	if err != nil {
+		clog.WithField("error", err.Error()).Debug("Backing off after failure")
+		// Stale credentials are still better than none until they expire.
+		if (creds != nil) && time.Now().Before(*creds.Expiration) {
 			return creds, nil
 		}
-		clog.Debug("Credential is stale, refreshing")
+		return nil, err
+	}
+
+	// Only one request per key is sent to STS at a time, and every caller
+	// which arrives while it's in flight waits for its result. The cache is
+	// checked again in case a request completed since it was last checked.
+	store.pendingMutex.Lock()
+	pending, hasKey := store.pending[key]
+	if hasKey {
+		store.pendingMutex.Unlock()
+		clog.Debug("Waiting for in-flight refresh")
+		<-pending.done
+		return pending.credentials, pending.err
+	}
+	creds, isFresh = store.cachedCredential(key, gracePeriod)
+	if isFresh {
+		store.pendingMutex.Unlock()
+		return creds, nil
+	}
+	pending = &pendingRefresh{done: make(chan struct{})}
+	store.pending[key] = pending
+	store.pendingMutex.Unlock()
+
+	pending.credentials, pending.err = store.assumeCredential(role, requested, key, gracePeriod, clog)
+	if pending.err != nil {
+		failure := store.failures.record(key, role.ARN, pending.err)
+		clog.WithFields(logrus.Fields{
+			"class":    failure.Class,
+			"failures": failure.Count,
+			"retry-at": failure.RetryAt.Format(time.RFC3339),
+			"error":    failure.Error,
+		}).Warn("Unable to assume role")
 	} else {
-		clog.Debug("Credential is not in the store")
+		store.failures.clear(key)
 	}
 
-	duration := int64(3600)
-	sessionName := store.generateSessionName()
+	store.pendingMutex.Lock()
+	delete(store.pending, key)
+	store.pendingMutex.Unlock()
+	close(pending.done)
+
+	return pending.credentials, pending.err
+}
+
+// loadCache stores the credentials from the cache which are fresh for longer
+// than the real time grace period, discarding the rest. Credentials whose role
+// was requested with an external ID or chain from the config are discarded
+// as well once the config changes.
+func (store *credentialStore) loadCache() {
+	cached, err := store.config.Cache.Load()
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("Unable to load credential cache")
+		return
+	}
+	fresh := time.Now().Add(realTimeGracePeriod)
+	for idx := range cached {
+		role := cached[idx].Role
+		requested := cached[idx].Requested
+		creds := cached[idx].Credentials
+		clog := log.WithField("arn", role.ARN)
+		if (creds == nil) || (creds.Credentials == nil) || (creds.Expiration == nil) || !fresh.Before(*creds.Expiration) {
+			clog.Debug("Discarding stale cached credential")
+			continue
+		}
+		key := role.Key()
+		if store.resolveRole(&requested).Key() != key {
+			clog.Info("Discarding cached credential which no longer matches the config")
+			continue
+		}
+		store.creds[key] = &cachedCredentials{role: role, requested: requested, credentials: creds}
+		store.scheduleRefresh(key, creds)
+		clog.Info("Loaded cached credential")
+	}
+}
 
-	output, err := store.client.AssumeRole(&sts.AssumeRoleInput{
-		RoleArn:         &arn,
-		DurationSeconds: &duration,
-		RoleSessionName: &sessionName,
+// saveCache persists every credential in the store once the save delay has
+// elapsed, when a cache is configured. Changes made while a save is pending
+// are written by that save, so that assuming many roles at once, such as the
+// roles of a chain, only rewrites the cache once.
+func (store *credentialStore) saveCache() {
+	if store.config.Cache == nil {
+		return
+	}
+	delay := store.config.CacheSaveDelay
+	if delay == 0 {
+		delay = defaultSaveDelay
+	}
+	store.saveMutex.Lock()
+	defer store.saveMutex.Unlock()
+	if store.saveTimer == nil {
+		store.saveTimer = time.AfterFunc(delay, store.writeCache)
+	}
+}
+
+// flushCache writes a pending save immediately.
+func (store *credentialStore) flushCache() {
+	store.saveMutex.Lock()
+	timer := store.saveTimer
+	store.saveMutex.Unlock()
+	if (timer != nil) && timer.Stop() {
+		store.writeCache()
+	}
+}
+
+// writeCache persists every credential in the store. Writes are serialized so
+// that the newest credentials are always written last.
+func (store *credentialStore) writeCache() {
+	store.cacheMutex.Lock()
+	defer store.cacheMutex.Unlock()
+
+	// Changes made from now on are written by the next save.
+	store.saveMutex.Lock()
+	store.saveTimer = nil
+	store.saveMutex.Unlock()
+
+	store.credMutex.RLock()
+	creds := make([]CachedCredential, 0, len(store.creds))
+	for _, cached := range store.creds {
+		creds = append(creds, CachedCredential{Role: cached.role, Requested: cached.requested, Credentials: cached.credentials})
+	}
+	store.credMutex.RUnlock()
+
+	err := store.config.Cache.Save(creds)
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("Unable to save credential cache")
+	}
+}
+
+// scheduleRefresh queues the refresh of the credential at a random point in the
+// last half of its grace period, so that credentials which were issued together
+// aren't refreshed together.
+func (store *credentialStore) scheduleRefresh(key string, creds *Credentials) {
+	gracePeriod := refreshGracePeriod
+	lifetime := creds.Expiration.Sub(creds.LastUpdated)
+	if gracePeriod > lifetime/2 {
+		gracePeriod = lifetime / 2
+	}
+	if gracePeriod <= 0 {
+		// Credentials which were issued already expired are refreshed when
+		// they're next requested.
+		return
+	}
+	store.rngMutex.Lock()
+	jitter := time.Duration(store.rng.Int63n(int64(gracePeriod/2) + 1))
+	store.rngMutex.Unlock()
+	gracePeriod -= jitter
+
+	store.scheduler.schedule(&scheduledRefresh{
+		key:         key,
+		at:          creds.Expiration.Add(-gracePeriod),
+		credentials: creds,
+		gracePeriod: gracePeriod,
 	})
+}
+
+// runScheduledRefresh refreshes the credential, unless it has been evicted or
+// replaced since the refresh was scheduled. Failed refreshes are retried once
+// their backoff has elapsed.
+func (store *credentialStore) runScheduledRefresh(refresh *scheduledRefresh) {
+	role, isCurrent := store.scheduledRole(refresh)
+	if !isCurrent {
+		return
+	}
+	clog := log.WithField("arn", role.ARN)
+	clog.Debug("Running scheduled refresh")
+	_, err := store.refreshCredential(role, refresh.gracePeriod)
+	if _, isCurrent = store.scheduledRole(refresh); !isCurrent {
+		return
+	}
+
+	// The credential wasn't replaced, so the refresh failed, either now or
+	// while backing off from an earlier failure.
+	retryAt, isFailing := store.failures.retryAt(refresh.key)
+	if !isFailing {
+		retryAt = time.Now().Add(store.failures.minBackoff)
+	}
+	if err != nil {
+		clog = clog.WithField("error", err.Error())
+	}
+	clog.WithField("retry-at", retryAt.Format(time.RFC3339)).Warn("Unable to refresh credential")
+	retry := *refresh
+	retry.at = retryAt
+	store.scheduler.schedule(&retry)
+}
+
+// scheduledRole returns the role of the scheduled refresh as it was requested,
+// and whether its credential is still the one which the refresh was scheduled
+// for.
+func (store *credentialStore) scheduledRole(refresh *scheduledRefresh) (*Role, bool) {
+	store.credMutex.RLock()
+	defer store.credMutex.RUnlock()
+
+	cached, hasKey := store.creds[refresh.key]
+	if !hasKey || (cached.credentials != refresh.credentials) {
+		return nil, false
+	}
+	role := cached.requested
+	return &role, true
+}
+
+// touchRole marks the role, along with any intermediate roles, as used at the
+// given time. The caller must hold the credMutex.
+func (store *credentialStore) touchRole(role *Role, now time.Time) {
+	role = store.resolveRole(role)
+	store.lastUsed[role.Key()] = now
+	chain := role.Chain
+	if len(chain) > 0 {
+		last := len(chain) - 1
+		store.touchRole(&Role{ARN: chain[last], Chain: chain[:last]}, now)
+	}
+}
+
+// cachedCredential looks up the credential in the store, and determines whether
+// it's fresh for at least the grace period.
+func (store *credentialStore) cachedCredential(key string, gracePeriod time.Duration) (*Credentials, bool) {
+	store.credMutex.RLock()
+	cached, hasKey := store.creds[key]
+	store.credMutex.RUnlock()
+	if !hasKey {
+		return nil, false
+	}
+
+	creds := cached.credentials
+	// Short sessions would always be within the refresh grace period, so
+	// they are refreshed halfway through their lifetime instead.
+	lifetime := creds.Expiration.Sub(creds.LastUpdated)
+	if (gracePeriod > lifetime/2) && (lifetime/2 > realTimeGracePeriod) {
+		gracePeriod = lifetime / 2
+	}
+	return creds, time.Now().Add(gracePeriod).Before(*creds.Expiration)
+}
+
+// assumeCredential assumes the role, along with any intermediate roles, and
+// stores the credential along with the role as it was requested.
+func (store *credentialStore) assumeCredential(role *Role, requested *Role, key string, gracePeriod time.Duration, clog *logrus.Entry) (*Credentials, error) {
+	request := &CredentialRequest{
+		Role:        role,
+		SessionName: role.SessionName,
+		ExternalID:  role.ExternalID,
+	}
+	if request.SessionName == "" {
+		request.SessionName = store.generateSessionName()
+	}
+
+	chain := role.Chain
+	if len(chain) > 0 {
+		if !store.source.CanChain() {
+			return nil, fmt.Errorf("Role chaining is not configured, unable to assume: %s", role.ARN)
+		}
+		// Each intermediate role is cached and refreshed like any other, and
+		// must outlive the grace period of the role it's used to assume.
+		last := len(chain) - 1
+		parent, err := store.refreshCredential(&Role{ARN: chain[last], Chain: chain[:last]}, gracePeriod)
+		if err != nil {
+			// The intermediate role's error is returned as is, so that it's
+			// classified the same way.
+			clog.WithField("via", chain[last]).Warn("Unable to assume intermediate role")
+			return nil, err
+		}
+		request.Parent = parent.Credentials
+		clog = clog.WithField("via", chain[last])
+	}
+
+	request.Duration = store.durationForRole(role, len(chain) > 0)
+	issued, err := store.source.IssueCredentials(request)
+	if isDurationError(err) && (request.Duration > defaultDuration) {
+		// Every role allows sessions of at least an hour, but longer sessions
+		// must be allowed by the role's maximum session duration. Its maximum
+		// is found by stepping down an hour at a time, which only needs
+		// permission to assume the role.
+		clog.WithFields(logrus.Fields{
+			"duration": request.Duration.String(),
+			"error":    err.Error(),
+		}).Warn("Session duration exceeds the role's maximum, trying shorter durations")
+		for isDurationError(err) && (request.Duration > defaultDuration) {
+			next := (request.Duration / time.Hour) * time.Hour
+			if next == request.Duration {
+				next -= time.Hour
+			}
+			request.Duration = next
+			issued, err = store.source.IssueCredentials(request)
+		}
+		if err == nil {
+			clog.WithField("max-duration", request.Duration.String()).Info("Found the role's maximum session duration")
+			store.durationMutex.Lock()
+			store.maxDurations[role.ARN] = request.Duration
+			store.durationMutex.Unlock()
+		}
+	}
 
 	if err != nil {
 		return nil, err
-	} else if output.Credentials == nil {
-		return nil, fmt.Errorf("No credentials returned for: %s", arn)
+	} else if issued == nil {
+		return nil, fmt.Errorf("No credentials returned for: %s", role.ARN)
+	}
+
+	creds := &Credentials{
+		Credentials: issued,
+		LastUpdated: time.Now(),
 	}
 
-	clog.Info("Credential successfully refreshed")
+	clog.WithField("duration", request.Duration.String()).Info("Credential successfully refreshed")
 	store.credMutex.Lock()
-	store.creds[arn] = output.Credentials
+	store.creds[key] = &cachedCredentials{role: *role, requested: *requested, credentials: creds}
 	store.credMutex.Unlock()
+	store.scheduleRefresh(key, creds)
+	store.saveCache()
 
-	return output.Credentials, nil
+	return creds, nil
+}
+
+// resolveRole fills in the parts of the role which come from the store's
+// config, so that its key changes along with the config.
+func (store *credentialStore) resolveRole(role *Role) *Role {
+	resolved := *role
+	if resolved.ExternalID == "" {
+		resolved.ExternalID = store.config.ExternalIDs[role.ARN]
+	}
+	if resolved.Chain == nil {
+		resolved.Chain = store.config.Chains[role.ARN]
+	}
+	return &resolved
+}
+
+// durationForRole determines the session duration of the role. The duration
+// requested by the role is preferred to the default, and is capped by the
+// role's maximum once STS has rejected it. Sessions assumed with the
+// credentials of another role can't last longer than an hour.
+func (store *credentialStore) durationForRole(role *Role, chained bool) time.Duration {
+	duration := role.Duration
+	if duration == 0 {
+		duration = store.config.DefaultDuration
+	}
+	if duration == 0 {
+		duration = defaultDuration
+	} else if duration < minDuration {
+		duration = minDuration
+	} else if duration > maxDuration {
+		duration = maxDuration
+	}
+
+	store.durationMutex.RLock()
+	max, hasKey := store.maxDurations[role.ARN]
+	store.durationMutex.RUnlock()
+	if hasKey && (duration > max) {
+		duration = max
+	}
+	if chained && (duration > maxChainedDuration) {
+		duration = maxChainedDuration
+	}
+
+	return duration
 }
 
 func (store *credentialStore) generateSessionName() string {
@@ -111,10 +503,40 @@ func (store *credentialStore) generateSessionName() string {
 	return string(ary[:])
 }
 
+// isDurationError returns true when STS rejected the requested session
+// duration.
+func isDurationError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == validationErrorCode) && strings.Contains(awsErr.Message(), "DurationSeconds")
+}
+
+type pendingRefresh struct {
+	done        chan struct{}
+	credentials *Credentials
+	err         error
+}
+
+type cachedCredentials struct {
+	role        Role
+	requested   Role
+	credentials *Credentials
+}
+
 type credentialStore struct {
-	client    STSClient
-	creds     map[string]*sts.Credentials
-	rng       *rand.Rand
-	rngMutex  sync.Mutex
-	credMutex sync.RWMutex
+	source        CredentialSource
+	config        *Config
+	creds         map[string]*cachedCredentials
+	lastUsed      map[string]time.Time
+	maxDurations  map[string]time.Duration
+	pending       map[string]*pendingRefresh
+	failures      *failureTracker
+	scheduler     *refreshScheduler
+	rng           *rand.Rand
+	rngMutex      sync.Mutex
+	credMutex     sync.RWMutex
+	durationMutex sync.RWMutex
+	pendingMutex  sync.Mutex
+	cacheMutex    sync.Mutex
+	saveMutex     sync.Mutex
+	saveTimer     *time.Timer
 }
@@ -1,11 +1,20 @@
 package iam_test
 
 import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/swipely/iam-docker/src/iam"
 	"github.com/swipely/iam-docker/src/mock"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,7 +26,7 @@ var _ = Describe("CredentialStore", func() {
 
 	BeforeEach(func() {
 		client = mock.NewSTSClient()
-		subject = NewCredentialStore(client, 1)
+		subject = NewCredentialStore(client, 1, &Config{})
 	})
 
 	Describe("CredentialsForRole", func() {
@@ -28,7 +37,7 @@ var _ = Describe("CredentialStore", func() {
 		Context("When the credentials have not been assumed", func() {
 			Context("When the credentials cannot be assumed", func() {
 				It("Returns an error", func() {
-					creds, err := subject.CredentialsForRole(role)
+					creds, err := subject.CredentialsForRole(&Role{ARN: role})
 					Expect(creds).To(BeNil())
 					Expect(err).ToNot(BeNil())
 				})
@@ -52,7 +61,7 @@ var _ = Describe("CredentialStore", func() {
 				})
 
 				It("Returns the credentials", func() {
-					creds, err := subject.CredentialsForRole(role)
+					creds, err := subject.CredentialsForRole(&Role{ARN: role})
 					Expect(creds).ToNot(BeNil())
 					Expect(err).To(BeNil())
 					Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
@@ -79,7 +88,7 @@ var _ = Describe("CredentialStore", func() {
 
 			BeforeEach(func() {
 				client.AssumableRoles[role] = creds
-				_, _ = subject.CredentialsForRole(role)
+				_, _ = subject.CredentialsForRole(&Role{ARN: role})
 			})
 
 			Context("But they are about to go stale", func() {
@@ -100,7 +109,7 @@ var _ = Describe("CredentialStore", func() {
 				})
 
 				It("Refreshes them", func() {
-					creds, err := subject.CredentialsForRole(role)
+					creds, err := subject.CredentialsForRole(&Role{ARN: role})
 					Expect(creds).ToNot(BeNil())
 					Expect(err).To(BeNil())
 					Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
@@ -117,7 +126,7 @@ var _ = Describe("CredentialStore", func() {
 				})
 
 				It("Returns the credentials", func() {
-					creds, err := subject.CredentialsForRole(role)
+					creds, err := subject.CredentialsForRole(&Role{ARN: role})
 					Expect(creds).ToNot(BeNil())
 					Expect(err).To(BeNil())
 					Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
@@ -129,7 +138,569 @@ var _ = Describe("CredentialStore", func() {
 		})
 	})
 
-	Describe("RefreshCredentials", func() {
+	Describe("Session duration", func() {
+		const (
+			role = "arn:aws:iam::012345678901:role/batch"
+		)
+
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(12 * time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+		})
+
+		Context("When the role does not request a duration", func() {
+			It("Uses the default", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(3600)))
+			})
+
+			It("Uses the configured default", func() {
+				subject = NewCredentialStore(client, 1, &Config{DefaultDuration: 2 * time.Hour})
+				_, err := subject.CredentialsForRole(&Role{ARN: role})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(7200)))
+			})
+		})
+
+		Context("When the role requests a duration", func() {
+			It("Uses the requested duration", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role, Duration: 12 * time.Hour})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(43200)))
+			})
+
+			It("Does not share credentials with other durations", func() {
+				_, _ = subject.CredentialsForRole(&Role{ARN: role})
+				_, _ = subject.CredentialsForRole(&Role{ARN: role, Duration: 12 * time.Hour})
+				Expect(client.Inputs).To(HaveLen(2))
+			})
+		})
+
+		Context("When the duration exceeds the role's maximum", func() {
+			BeforeEach(func() {
+				client.MaxDurations[role] = 3600
+			})
+
+			It("Falls back to one hour", func() {
+				creds, err := subject.CredentialsForRole(&Role{ARN: role, Duration: 12 * time.Hour})
+				Expect(err).To(BeNil())
+				Expect(creds).ToNot(BeNil())
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(3600)))
+			})
+
+			It("Remembers the role's maximum", func() {
+				_, _ = subject.CredentialsForRole(&Role{ARN: role, Duration: 12 * time.Hour})
+				count := len(client.Inputs)
+				_, err := subject.CredentialsForRole(&Role{ARN: role, Duration: 6 * time.Hour})
+				Expect(err).To(BeNil())
+				Expect(client.Inputs).To(HaveLen(count + 1))
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(3600)))
+			})
+		})
+
+		Context("When the duration exceeds a maximum of more than an hour", func() {
+			BeforeEach(func() {
+				client.MaxDurations[role] = 6 * 3600
+			})
+
+			It("Steps down to the role's maximum", func() {
+				creds, err := subject.CredentialsForRole(&Role{ARN: role, Duration: 12 * time.Hour})
+				Expect(err).To(BeNil())
+				Expect(creds).ToNot(BeNil())
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(6 * 3600)))
+				Expect(client.Inputs).To(HaveLen(7))
+			})
+
+			It("Steps down to whole hours", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role, Duration: 6*time.Hour + 30*time.Minute})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(6 * 3600)))
+				Expect(client.Inputs).To(HaveLen(2))
+			})
+
+			It("Remembers the role's maximum", func() {
+				_, _ = subject.CredentialsForRole(&Role{ARN: role, Duration: 12 * time.Hour})
+				count := len(client.Inputs)
+				_, err := subject.CredentialsForRole(&Role{ARN: role, Duration: 10 * time.Hour})
+				Expect(err).To(BeNil())
+				Expect(client.Inputs).To(HaveLen(count + 1))
+				Expect(*client.LastInput().DurationSeconds).To(Equal(int64(6 * 3600)))
+			})
+		})
+
+		It("Records when the credentials were issued", func() {
+			before := time.Now()
+			creds, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(creds.LastUpdated).To(BeTemporally(">=", before))
+			Expect(creds.LastUpdated).To(BeTemporally("<=", time.Now()))
+		})
+	})
+
+	Describe("External IDs", func() {
+		const (
+			role = "arn:aws:iam::210987654321:role/vendor"
+		)
+
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+			subject = NewCredentialStore(client, 1, &Config{
+				ExternalIDs: map[string]string{role: "configured"},
+			})
+		})
+
+		Context("When the role has an external ID", func() {
+			It("Assumes the role with it", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role, ExternalID: "labeled"})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().ExternalId).To(Equal("labeled"))
+			})
+		})
+
+		Context("When the role does not have an external ID", func() {
+			It("Assumes the role with the configured external ID", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().ExternalId).To(Equal("configured"))
+			})
+
+			It("Does not set an external ID for other roles", func() {
+				other := "arn:aws:iam::012345678901:role/other"
+				client.AssumableRoles[other] = client.AssumableRoles[role]
+				_, err := subject.CredentialsForRole(&Role{ARN: other})
+				Expect(err).To(BeNil())
+				Expect(client.LastInput().ExternalId).To(BeNil())
+			})
+		})
+
+		It("Keys credentials by the configured external ID", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, ExternalID: "configured"})
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+
+		It("Does not reuse saved credentials after the configured external ID changes", func() {
+			dir, err := ioutil.TempDir("", "iam-docker-cache")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+			cache, err := NewEncryptedFileCache(filepath.Join(dir, "credentials"), []byte("0123456789abcdef0123456789abcdef"))
+			Expect(err).To(BeNil())
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache, CacheSaveDelay: time.Millisecond})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			Eventually(cache.Load).Should(HaveLen(1))
+			subject = NewCredentialStore(client, 1, &Config{
+				ExternalIDs: map[string]string{role: "a,b=c"},
+				Cache:       cache,
+			})
+			_, err = subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(client.Inputs).To(HaveLen(2))
+			Expect(*client.LastInput().ExternalId).To(Equal("a,b=c"))
+		})
+
+		It("Does not share credentials between external IDs", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, ExternalID: "one"})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, ExternalID: "two"})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, ExternalID: "one"})
+			Expect(client.Inputs).To(HaveLen(2))
+		})
+	})
+
+	Describe("Session tags", func() {
+		const (
+			role = "arn:aws:iam::012345678901:role/abac"
+		)
+
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+		})
+
+		It("Assumes the role with the tags, sorted by key", func() {
+			_, err := subject.CredentialsForRole(&Role{
+				ARN:               role,
+				Tags:              map[string]string{"team": "payments", "env": "production"},
+				TransitiveTagKeys: []string{"team"},
+			})
+			Expect(err).To(BeNil())
+			input := client.LastInput()
+			Expect(input.Tags).To(HaveLen(2))
+			Expect(*input.Tags[0].Key).To(Equal("env"))
+			Expect(*input.Tags[0].Value).To(Equal("production"))
+			Expect(*input.Tags[1].Key).To(Equal("team"))
+			Expect(*input.Tags[1].Value).To(Equal("payments"))
+			Expect(input.TransitiveTagKeys).To(HaveLen(1))
+			Expect(*input.TransitiveTagKeys[0]).To(Equal("team"))
+		})
+
+		It("Does not set tags for roles without them", func() {
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(client.LastInput().Tags).To(BeEmpty())
+		})
+
+		It("Shares credentials only between identical tag sets", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, Tags: map[string]string{"team": "payments", "env": "production"}})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, Tags: map[string]string{"env": "production", "team": "payments"}})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, Tags: map[string]string{"team": "search", "env": "production"}})
+			Expect(client.Inputs).To(HaveLen(2))
+		})
+	})
+
+	Describe("Session policies", func() {
+		const (
+			role   = "arn:aws:iam::012345678901:role/platform"
+			policy = `{"Version":"2012-10-17","Statement":[]}`
+		)
+
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+		})
+
+		It("Assumes the role with the policies", func() {
+			_, err := subject.CredentialsForRole(&Role{
+				ARN:        role,
+				Policy:     policy,
+				PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			})
+			Expect(err).To(BeNil())
+			input := client.LastInput()
+			Expect(*input.Policy).To(Equal(policy))
+			Expect(input.PolicyArns).To(HaveLen(1))
+			Expect(*input.PolicyArns[0].Arn).To(Equal("arn:aws:iam::aws:policy/ReadOnlyAccess"))
+		})
+
+		It("Does not share credentials between policies", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, Policy: policy})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, Policy: policy})
+			Expect(client.Inputs).To(HaveLen(2))
+			Expect(client.Inputs[0].Policy).To(BeNil())
+		})
+	})
+
+	Describe("Session names", func() {
+		const (
+			role = "arn:aws:iam::012345678901:role/test"
+		)
+
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+		})
+
+		Context("When the role has a session name and source identity", func() {
+			It("Assumes the role with them", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role, SessionName: "web@worker-1", SourceIdentity: "billing"})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().RoleSessionName).To(Equal("web@worker-1"))
+				Expect(*client.LastInput().SourceIdentity).To(Equal("billing"))
+			})
+		})
+
+		Context("When the role does not have a session name", func() {
+			It("Generates a random name", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role})
+				Expect(err).To(BeNil())
+				Expect(*client.LastInput().RoleSessionName).To(MatchRegexp("^[A-Z]{16}$"))
+				Expect(client.LastInput().SourceIdentity).To(BeNil())
+			})
+		})
+	})
+
+	Describe("Role chaining", func() {
+		const (
+			broker  = "arn:aws:iam::111111111111:role/broker"
+			role    = "arn:aws:iam::222222222222:role/production"
+			another = "arn:aws:iam::222222222222:role/reports"
+		)
+
+		var (
+			brokerKeyID     = "brokeraccesskeyid"
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[broker] = &sts.Credentials{
+				AccessKeyId:     &brokerKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+			client.AssumableRoles[another] = client.AssumableRoles[role]
+			subject = NewCredentialStore(client, 1, &Config{
+				Chains:        map[string][]string{another: []string{broker}},
+				ChainedClient: client.ClientForCredentials,
+			})
+		})
+
+		It("Assumes each role with the credentials of the previous one", func() {
+			creds, err := subject.CredentialsForRole(&Role{ARN: role, Chain: []string{broker}})
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
+			Expect(client.Inputs).To(HaveLen(2))
+			Expect(*client.Inputs[0].RoleArn).To(Equal(broker))
+			Expect(client.Callers[0]).To(Equal(""))
+			Expect(*client.Inputs[1].RoleArn).To(Equal(role))
+			Expect(client.Callers[1]).To(Equal(brokerKeyID))
+		})
+
+		It("Caps chained sessions at one hour", func() {
+			_, err := subject.CredentialsForRole(&Role{ARN: role, Chain: []string{broker}, Duration: 12 * time.Hour})
+			Expect(err).To(BeNil())
+			Expect(*client.LastInput().DurationSeconds).To(Equal(int64(3600)))
+		})
+
+		It("Caches the intermediate roles", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, Chain: []string{broker}})
+			_, err := subject.CredentialsForRole(&Role{ARN: another, Chain: []string{broker}})
+			Expect(err).To(BeNil())
+			Expect(client.Inputs).To(HaveLen(3))
+			Expect(client.Callers[2]).To(Equal(brokerKeyID))
+		})
+
+		Context("When the role does not have a chain", func() {
+			It("Uses the configured chain", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: another})
+				Expect(err).To(BeNil())
+				Expect(client.Callers).To(Equal([]string{"", brokerKeyID}))
+			})
+		})
+
+		Context("When the role has an empty chain", func() {
+			It("Assumes the role directly", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: another, Chain: []string{}})
+				Expect(err).To(BeNil())
+				Expect(client.Callers).To(Equal([]string{""}))
+			})
+		})
+
+		Context("When an intermediate role cannot be assumed", func() {
+			It("Returns an error", func() {
+				creds, err := subject.CredentialsForRole(&Role{ARN: role, Chain: []string{"arn:aws:iam::111111111111:role/missing"}})
+				Expect(creds).To(BeNil())
+				Expect(err).ToNot(BeNil())
+				Expect(client.Inputs).To(HaveLen(1))
+			})
+		})
+
+		Context("When chaining is not configured", func() {
+			BeforeEach(func() {
+				subject = NewCredentialStore(client, 1, &Config{})
+			})
+
+			It("Returns an error", func() {
+				_, err := subject.CredentialsForRole(&Role{ARN: role, Chain: []string{broker}})
+				Expect(err).ToNot(BeNil())
+				Expect(client.Inputs).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Concurrent requests", func() {
+		const (
+			role     = "arn:aws:iam::012345678901:role/test"
+			requests = 30
+		)
+
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour)
+		)
+
+		BeforeEach(func() {
+			client.AssumableRoles[role] = &sts.Credentials{
+				AccessKeyId:     &accessKeyID,
+				Expiration:      &expiration,
+				SecretAccessKey: &secretAccessKey,
+				SessionToken:    &sessionToken,
+			}
+			client.Gate = make(chan struct{})
+		})
+
+		It("Assumes the role once for every caller", func() {
+			var waitGroup sync.WaitGroup
+			errs := make(chan error, requests)
+			waitGroup.Add(requests)
+			for idx := 0; idx < requests; idx++ {
+				go func() {
+					defer waitGroup.Done()
+					creds, err := subject.CredentialsForRole(&Role{ARN: role})
+					if (err == nil) && (*creds.AccessKeyId != accessKeyID) {
+						err = fmt.Errorf("Unexpected access key ID: %s", *creds.AccessKeyId)
+					}
+					errs <- err
+				}()
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(client.Gate)
+			waitGroup.Wait()
+			close(errs)
+			for err := range errs {
+				Expect(err).To(BeNil())
+			}
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+
+		It("Shares the error with every caller", func() {
+			var waitGroup sync.WaitGroup
+			errs := make(chan error, requests)
+			waitGroup.Add(requests)
+			for idx := 0; idx < requests; idx++ {
+				go func() {
+					defer waitGroup.Done()
+					_, err := subject.CredentialsForRole(&Role{ARN: "arn:aws:iam::012345678901:role/missing"})
+					errs <- err
+				}()
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(client.Gate)
+			waitGroup.Wait()
+			close(errs)
+			for err := range errs {
+				Expect(err).ToNot(BeNil())
+			}
+			Expect(len(client.Inputs)).To(BeNumerically("<", requests))
+		})
+	})
+
+	Describe("Failures", func() {
+		const (
+			role = "arn:aws:iam::012345678901:role/denied"
+		)
+
+		BeforeEach(func() {
+			client.Errors[role] = awserr.New("AccessDenied", "Not authorized to perform: sts:AssumeRole", nil)
+			subject = NewCredentialStore(client, 1, &Config{
+				MinFailureBackoff: time.Millisecond,
+				MaxFailureBackoff: time.Hour,
+			})
+		})
+
+		It("Serves the cached error while backing off", func() {
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).ToNot(BeNil())
+			_, again := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(again).To(Equal(err))
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+
+		It("Retries after the backoff, doubling it", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			first := subject.Failures()[0]
+			Expect(first.RetryAt.Sub(first.LastAttempt)).To(Equal(16 * time.Millisecond))
+			time.Sleep(20 * time.Millisecond)
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).ToNot(BeNil())
+			Expect(client.Inputs).To(HaveLen(2))
+			second := subject.Failures()[0]
+			Expect(second.Count).To(Equal(2))
+			Expect(second.RetryAt.Sub(second.LastAttempt)).To(Equal(32 * time.Millisecond))
+		})
+
+		It("Classifies the errors", func() {
+			throttled := "arn:aws:iam::012345678901:role/throttled"
+			network := "arn:aws:iam::012345678901:role/network"
+			client.Errors[throttled] = awserr.New("Throttling", "Rate exceeded", nil)
+			client.Errors[network] = awserr.New("RequestError", "send request failed", &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+			for _, arn := range []string{role, throttled, network} {
+				_, _ = subject.CredentialsForRole(&Role{ARN: arn})
+			}
+			failures := subject.Failures()
+			Expect(failures).To(HaveLen(3))
+			Expect(failures[0].ARN).To(Equal(role))
+			Expect(failures[0].Class).To(Equal(AccessDeniedFailure))
+			Expect(failures[0].Error).To(ContainSubstring("sts:AssumeRole"))
+			Expect(failures[1].ARN).To(Equal(network))
+			Expect(failures[1].Class).To(Equal(NetworkFailure))
+			Expect(failures[2].ARN).To(Equal(throttled))
+			Expect(failures[2].Class).To(Equal(ThrottledFailure))
+		})
+
+		It("Forgets the failure once the role is assumed", func() {
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			delete(client.Errors, role)
+			expiration := time.Now().Add(time.Hour)
+			accessKeyID := "fakeaccesskeyid"
+			client.AssumableRoles[role] = &sts.Credentials{AccessKeyId: &accessKeyID, Expiration: &expiration}
+			time.Sleep(20 * time.Millisecond)
+			creds, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(creds).ToNot(BeNil())
+			Expect(subject.Failures()).To(BeEmpty())
+		})
+	})
+
+	Describe("Stale credentials", func() {
 		var (
 			role            = "arn:aws:iam::012345678901:role/test"
 			accessKeyID     = "fakeaccesskeyid"
@@ -153,12 +724,12 @@ var _ = Describe("CredentialStore", func() {
 
 		JustBeforeEach(func() {
 			client.AssumableRoles[role] = creds
-			_, _ = subject.CredentialsForRole(role)
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
 			client.AssumableRoles[role] = newCreds
 		})
 
-		It("Refreshes each credential in the store", func() {
-			found, err := subject.CredentialsForRole(role)
+		It("Are refreshed when they're requested", func() {
+			found, err := subject.CredentialsForRole(&Role{ARN: role})
 			Expect(creds).ToNot(BeNil())
 			Expect(err).To(BeNil())
 			Expect(*found.AccessKeyId).To(Equal(accessKeyID))
@@ -167,4 +738,299 @@ var _ = Describe("CredentialStore", func() {
 			Expect(*found.SessionToken).To(Equal(sessionToken))
 		})
 	})
+
+	Describe("ReconcileRoles", func() {
+		var (
+			used         = "arn:aws:iam::012345678901:role/used"
+			unused       = "arn:aws:iam::012345678901:role/unused"
+			intermediate = "arn:aws:iam::012345678901:role/intermediate"
+			accessKeyID  = "fakeaccesskeyid"
+		)
+
+		BeforeEach(func() {
+			// The credentials are fresh when requested, but stale when
+			// refreshed.
+			expiration := time.Now().Add(15 * time.Second)
+			creds := &sts.Credentials{
+				AccessKeyId: &accessKeyID,
+				Expiration:  &expiration,
+			}
+			client.AssumableRoles[used] = creds
+			client.AssumableRoles[unused] = creds
+			client.AssumableRoles[intermediate] = creds
+		})
+
+		Context("Without an idle timeout", func() {
+			It("Keeps every credential", func() {
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				subject.ReconcileRoles([]*Role{})
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				Expect(client.Inputs).To(HaveLen(1))
+			})
+		})
+
+		Context("With an idle timeout", func() {
+			BeforeEach(func() {
+				subject = NewCredentialStore(client, 1, &Config{
+					Chains:        map[string][]string{used: []string{intermediate}},
+					ChainedClient: client.ClientForCredentials,
+					IdleTimeout:   10 * time.Millisecond,
+				})
+				_, _ = subject.CredentialsForRole(&Role{ARN: used})
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				Expect(client.Inputs).To(HaveLen(3))
+			})
+
+			It("Evicts the roles which have been idle for longer than the timeout", func() {
+				time.Sleep(20 * time.Millisecond)
+				subject.ReconcileRoles([]*Role{{ARN: used}})
+				_, _ = subject.CredentialsForRole(&Role{ARN: used})
+				Expect(client.Inputs).To(HaveLen(3))
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				Expect(client.Inputs).To(HaveLen(4))
+				Expect(*client.LastInput().RoleArn).To(Equal(unused))
+			})
+
+			It("Keeps the used roles which have a configured external ID", func() {
+				subject = NewCredentialStore(client, 1, &Config{
+					ExternalIDs: map[string]string{unused: "configured"},
+					IdleTimeout: 10 * time.Millisecond,
+				})
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				count := len(client.Inputs)
+				for idx := 0; idx < 2; idx++ {
+					time.Sleep(20 * time.Millisecond)
+					subject.ReconcileRoles([]*Role{{ARN: unused}})
+				}
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				Expect(client.Inputs).To(HaveLen(count))
+			})
+
+			It("Keeps the roles which were recently requested", func() {
+				subject.ReconcileRoles([]*Role{})
+				_, _ = subject.CredentialsForRole(&Role{ARN: unused})
+				Expect(client.Inputs).To(HaveLen(3))
+			})
+
+			It("Forgets the failures of evicted roles", func() {
+				failing := "arn:aws:iam::012345678901:role/failing"
+				client.Errors[failing] = errors.New("Access denied")
+				_, _ = subject.CredentialsForRole(&Role{ARN: failing})
+				Expect(subject.Failures()).To(HaveLen(1))
+				time.Sleep(20 * time.Millisecond)
+				subject.ReconcileRoles([]*Role{})
+				Expect(subject.Failures()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("RunRefreshScheduler", func() {
+		var (
+			role        = "arn:aws:iam::012345678901:role/test"
+			accessKeyID = "fakeaccesskeyid"
+			stop        chan struct{}
+		)
+
+		BeforeEach(func() {
+			subject = NewCredentialStore(client, 1, &Config{
+				MinFailureBackoff: 10 * time.Millisecond,
+				RefreshWorkers:    2,
+			})
+			// The credential is refreshed between 100ms and 150ms after it's
+			// issued.
+			expiration := time.Now().Add(200 * time.Millisecond)
+			client.AssumableRoles[role] = &sts.Credentials{AccessKeyId: &accessKeyID, Expiration: &expiration}
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			stop = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(stop)
+		})
+
+		It("Refreshes the credential before it expires", func() {
+			expiration := time.Now().Add(time.Hour)
+			client.AssumableRoles[role] = &sts.Credentials{AccessKeyId: &accessKeyID, Expiration: &expiration}
+			go subject.RunRefreshScheduler(stop)
+			Eventually(client.InputCount, 300*time.Millisecond, 5*time.Millisecond).Should(Equal(2))
+			Consistently(client.InputCount, 100*time.Millisecond).Should(Equal(2))
+		})
+
+		It("Retries failed refreshes with backoff", func() {
+			client.Errors[role] = awserr.New("Throttling", "Rate exceeded", nil)
+			go subject.RunRefreshScheduler(stop)
+			Eventually(func() int {
+				failures := subject.Failures()
+				if len(failures) == 0 {
+					return 0
+				}
+				return failures[0].Count
+			}, time.Second, 5*time.Millisecond).Should(BeNumerically(">=", 3))
+		})
+
+		It("Skips the credentials of evicted roles", func() {
+			subject = NewCredentialStore(client, 1, &Config{IdleTimeout: time.Millisecond})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			time.Sleep(5 * time.Millisecond)
+			subject.ReconcileRoles([]*Role{})
+			go subject.RunRefreshScheduler(stop)
+			Consistently(client.InputCount, 250*time.Millisecond).Should(Equal(2))
+		})
+	})
+
+	Describe("Cache", func() {
+		var (
+			dir         string
+			cache       CredentialCache
+			role        = "arn:aws:iam::012345678901:role/test"
+			accessKeyID = "fakeaccesskeyid"
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "iam-docker-cache")
+			Expect(err).To(BeNil())
+			cache, err = NewEncryptedFileCache(filepath.Join(dir, "credentials"), []byte("0123456789abcdef0123456789abcdef"))
+			Expect(err).To(BeNil())
+			expiration := time.Now().Add(time.Hour)
+			client.AssumableRoles[role] = &sts.Credentials{AccessKeyId: &accessKeyID, Expiration: &expiration}
+		})
+
+		AfterEach(func() {
+			_ = os.RemoveAll(dir)
+		})
+
+		It("Saves each credential which is assumed", func() {
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache, CacheSaveDelay: time.Millisecond})
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Eventually(cache.Load).Should(HaveLen(1))
+			saved, err := cache.Load()
+			Expect(err).To(BeNil())
+			Expect(saved[0].Role.ARN).To(Equal(role))
+			Expect(*saved[0].Credentials.AccessKeyId).To(Equal(accessKeyID))
+		})
+
+		It("Saves the credentials assumed together at once", func() {
+			broker := "arn:aws:iam::012345678901:role/broker"
+			client.AssumableRoles[broker] = client.AssumableRoles[role]
+			var saves int32
+			subject = NewCredentialStore(client, 1, &Config{
+				Cache:          &countingCache{CredentialCache: cache, saves: &saves},
+				CacheSaveDelay: 50 * time.Millisecond,
+				ChainedClient:  client.ClientForCredentials,
+			})
+			_, err := subject.CredentialsForRole(&Role{ARN: role, Chain: []string{broker}})
+			Expect(err).To(BeNil())
+			Eventually(cache.Load).Should(HaveLen(2))
+			Consistently(func() int32 { return atomic.LoadInt32(&saves) }, 100*time.Millisecond).Should(Equal(int32(1)))
+		})
+
+		It("Saves pending credentials when the refresh scheduler stops", func() {
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache, CacheSaveDelay: time.Hour})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			stop := make(chan struct{})
+			close(stop)
+			subject.RunRefreshScheduler(stop)
+			Expect(cache.Load()).To(HaveLen(1))
+		})
+
+		It("Loads the saved credentials when the store is created", func() {
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache, CacheSaveDelay: time.Millisecond})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			Eventually(cache.Load).Should(HaveLen(1))
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache})
+			creds, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+
+		It("Discards stale credentials when the store is created", func() {
+			expiration := time.Now().Add(time.Second)
+			staleKeyID := "stalekeyid"
+			Expect(cache.Save([]CachedCredential{{
+				Role: Role{ARN: role},
+				Credentials: &Credentials{
+					Credentials: &sts.Credentials{AccessKeyId: &staleKeyID, Expiration: &expiration},
+					LastUpdated: time.Now().Add(-time.Hour),
+				},
+			}})).To(BeNil())
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache})
+			creds, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal(accessKeyID))
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+
+		It("Discards saved credentials which no longer match the configured chain", func() {
+			broker := "arn:aws:iam::012345678901:role/broker"
+			client.AssumableRoles[broker] = client.AssumableRoles[role]
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache, CacheSaveDelay: time.Millisecond})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			Eventually(cache.Load).Should(HaveLen(1))
+			subject = NewCredentialStore(client, 1, &Config{
+				Cache:         cache,
+				Chains:        map[string][]string{role: {broker}},
+				ChainedClient: client.ClientForCredentials,
+			})
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(client.Inputs).To(HaveLen(3))
+			Expect(*client.LastInput().RoleArn).To(Equal(role))
+		})
+
+		It("Discards saved credentials which were assumed with a configured external ID that changed", func() {
+			subject = NewCredentialStore(client, 1, &Config{
+				Cache:          cache,
+				CacheSaveDelay: time.Millisecond,
+				ExternalIDs:    map[string]string{role: "one"},
+			})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role})
+			Eventually(cache.Load).Should(HaveLen(1))
+			subject = NewCredentialStore(client, 1, &Config{
+				Cache:       cache,
+				ExternalIDs: map[string]string{role: "two"},
+			})
+			_, err := subject.CredentialsForRole(&Role{ARN: role, ExternalID: "one"})
+			Expect(err).To(BeNil())
+			Expect(client.Inputs).To(HaveLen(2))
+		})
+
+		It("Keeps saved credentials which were assumed with a labeled external ID", func() {
+			subject = NewCredentialStore(client, 1, &Config{
+				Cache:          cache,
+				CacheSaveDelay: time.Millisecond,
+				ExternalIDs:    map[string]string{role: "one"},
+			})
+			_, _ = subject.CredentialsForRole(&Role{ARN: role, ExternalID: "label"})
+			Eventually(cache.Load).Should(HaveLen(1))
+			subject = NewCredentialStore(client, 1, &Config{
+				Cache:       cache,
+				ExternalIDs: map[string]string{role: "two"},
+			})
+			_, err := subject.CredentialsForRole(&Role{ARN: role, ExternalID: "label"})
+			Expect(err).To(BeNil())
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+
+		It("Starts empty when the cache can't be loaded", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "credentials"), []byte("garbage"), 0600)).To(BeNil())
+			subject = NewCredentialStore(client, 1, &Config{Cache: cache})
+			_, err := subject.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(client.Inputs).To(HaveLen(1))
+		})
+	})
 })
+
+type countingCache struct {
+	CredentialCache
+	saves *int32
+}
+
+func (cache *countingCache) Save(creds []CachedCredential) error {
+	atomic.AddInt32(cache.saves, 1)
+	return cache.CredentialCache.Save(creds)
+}
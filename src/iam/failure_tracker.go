@@ -0,0 +1,201 @@
+package iam
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinFailureBackoff = time.Second
+	defaultMaxFailureBackoff = time.Minute * 5
+)
+
+// Classes of errors returned when assuming a role.
+const (
+	AccessDeniedFailure   = "access-denied"
+	InvalidRequestFailure = "invalid-request"
+	ThrottledFailure      = "throttled"
+	NetworkFailure        = "network"
+	UnknownFailure        = "unknown"
+)
+
+var (
+	accessDeniedCodes = map[string]bool{
+		"AccessDenied":                true,
+		"AccessDeniedException":       true,
+		"ExpiredTokenException":       true,
+		"InvalidClientTokenId":        true,
+		"RegionDisabledException":     true,
+		"SignatureDoesNotMatch":       true,
+		"UnrecognizedClientException": true,
+	}
+	invalidRequestCodes = map[string]bool{
+		"MalformedPolicyDocument": true,
+		"PackedPolicyTooLarge":    true,
+		"ValidationError":         true,
+	}
+	throttledCodes = map[string]bool{
+		"PriorRequestNotComplete":  true,
+		"RequestLimitExceeded":     true,
+		"RequestThrottled":         true,
+		"Throttling":               true,
+		"ThrottlingException":      true,
+		"TooManyRequestsException": true,
+	}
+	networkCodes = map[string]bool{
+		"RequestError":   true,
+		"RequestTimeout": true,
+	}
+	// backoffFactors scale the backoff of each class. Access which is denied
+	// or requests which are invalid are unlikely to succeed soon, while
+	// throttling and network errors are usually brief.
+	backoffFactors = map[string]time.Duration{
+		AccessDeniedFailure:   16,
+		InvalidRequestFailure: 16,
+		ThrottledFailure:      1,
+		NetworkFailure:        1,
+		UnknownFailure:        4,
+	}
+)
+
+// newFailureTracker remembers the roles which could not be assumed, so that
+// they aren't retried until their backoff has elapsed.
+func newFailureTracker(minBackoff time.Duration, maxBackoff time.Duration) *failureTracker {
+	if minBackoff == 0 {
+		minBackoff = defaultMinFailureBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxFailureBackoff
+	}
+	return &failureTracker{
+		failures:   make(map[string]*trackedFailure),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// check returns the error of the most recent failure when the key is still
+// backing off, or nil when it may be retried.
+func (tracker *failureTracker) check(key string) error {
+	tracker.mutex.RLock()
+	defer tracker.mutex.RUnlock()
+
+	failure, hasKey := tracker.failures[key]
+	if hasKey && time.Now().Before(failure.RetryAt) {
+		return failure.err
+	}
+	return nil
+}
+
+// retryAt returns when the key may be retried, if it has failed.
+func (tracker *failureTracker) retryAt(key string) (time.Time, bool) {
+	tracker.mutex.RLock()
+	defer tracker.mutex.RUnlock()
+
+	failure, hasKey := tracker.failures[key]
+	if !hasKey {
+		return time.Time{}, false
+	}
+	return failure.RetryAt, true
+}
+
+// record remembers the failure, doubling the backoff of each consecutive
+// failure up to the maximum.
+func (tracker *failureTracker) record(key string, arn string, err error) *Failure {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	failure, hasKey := tracker.failures[key]
+	if !hasKey {
+		failure = &trackedFailure{Failure: Failure{ARN: arn}}
+		tracker.failures[key] = failure
+	}
+	now := time.Now()
+	failure.Class = classifyError(err)
+	failure.Error = err.Error()
+	failure.Count++
+	failure.LastAttempt = now
+	failure.RetryAt = now.Add(tracker.backoff(failure.Class, failure.Count))
+	failure.err = err
+
+	result := failure.Failure
+	return &result
+}
+
+// clear forgets the failures of the key once it has been assumed.
+func (tracker *failureTracker) clear(key string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	delete(tracker.failures, key)
+}
+
+// list returns the tracked failures, sorted by ARN.
+func (tracker *failureTracker) list() []Failure {
+	tracker.mutex.RLock()
+	failures := make([]Failure, 0, len(tracker.failures))
+	for _, failure := range tracker.failures {
+		failures = append(failures, failure.Failure)
+	}
+	tracker.mutex.RUnlock()
+
+	sort.Sort(failuresByARN(failures))
+	return failures
+}
+
+func (tracker *failureTracker) backoff(class string, count int) time.Duration {
+	backoff := tracker.minBackoff * backoffFactors[class]
+	for attempt := 1; (attempt < count) && (backoff < tracker.maxBackoff); attempt++ {
+		backoff *= 2
+	}
+	if backoff > tracker.maxBackoff {
+		backoff = tracker.maxBackoff
+	}
+	return backoff
+}
+
+// classifyError determines whether the error was caused by the role's
+// permissions, an invalid request, STS throttling, or the network.
+func classifyError(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		code := awsErr.Code()
+		if accessDeniedCodes[code] {
+			return AccessDeniedFailure
+		} else if invalidRequestCodes[code] {
+			return InvalidRequestFailure
+		} else if throttledCodes[code] {
+			return ThrottledFailure
+		} else if networkCodes[code] {
+			return NetworkFailure
+		}
+		if _, ok := awsErr.OrigErr().(net.Error); ok {
+			return NetworkFailure
+		}
+		return UnknownFailure
+	}
+	if _, ok := err.(net.Error); ok {
+		return NetworkFailure
+	}
+	return UnknownFailure
+}
+
+type trackedFailure struct {
+	Failure
+	err error
+}
+
+type failureTracker struct {
+	failures   map[string]*trackedFailure
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	mutex      sync.RWMutex
+}
+
+type failuresByARN []Failure
+
+func (failures failuresByARN) Len() int           { return len(failures) }
+func (failures failuresByARN) Swap(i, j int)      { failures[i], failures[j] = failures[j], failures[i] }
+func (failures failuresByARN) Less(i, j int) bool { return failures[i].ARN < failures[j].ARN }
@@ -0,0 +1,120 @@
+package iam
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	cacheKeySize  = 32
+	cacheFileMode = 0600
+)
+
+// DecodeCacheKey decodes a base64 encoded 256 bit key, such as one generated
+// by `openssl rand -base64 32`.
+func DecodeCacheKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode cache key: %s", err.Error())
+	} else if len(key) != cacheKeySize {
+		return nil, fmt.Errorf("Cache key must be %d bytes, not %d", cacheKeySize, len(key))
+	}
+	return key, nil
+}
+
+// NewEncryptedFileCache creates a CredentialCache which stores credentials in
+// a file, encrypted with AES-GCM using the given 256 bit key.
+func NewEncryptedFileCache(path string, key []byte) (CredentialCache, error) {
+	if len(key) != cacheKeySize {
+		return nil, fmt.Errorf("Cache key must be %d bytes, not %d", cacheKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileCache{path: path, aead: aead}, nil
+}
+
+// Load reads and decrypts the credentials in the file. A missing file holds no
+// credentials.
+func (cache *encryptedFileCache) Load() ([]CachedCredential, error) {
+	content, err := ioutil.ReadFile(cache.path)
+	if os.IsNotExist(err) {
+		return []CachedCredential{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	nonceSize := cache.aead.NonceSize()
+	if len(content) < nonceSize {
+		return nil, fmt.Errorf("Credential cache is truncated: %s", cache.path)
+	}
+	plaintext, err := cache.aead.Open(nil, content[:nonceSize], content[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt credential cache: %s", cache.path)
+	}
+
+	var creds []CachedCredential
+	err = json.Unmarshal(plaintext, &creds)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Save encrypts the credentials and replaces the file with them. The file is
+// written in full before it's renamed over the old one, so that it's never
+// read half written.
+func (cache *encryptedFileCache) Save(creds []CachedCredential) error {
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, cache.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	content := cache.aead.Seal(nonce, nonce, plaintext, nil)
+
+	file, err := ioutil.TempFile(filepath.Dir(cache.path), "."+filepath.Base(cache.path))
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Chmod(cacheFileMode)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), cache.path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+type encryptedFileCache struct {
+	path string
+	aead cipher.AEAD
+}
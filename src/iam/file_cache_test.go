@@ -0,0 +1,126 @@
+package iam_test
+
+import (
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go/service/sts"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/swipely/iam-docker/src/iam"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("EncryptedFileCache", func() {
+	var (
+		dir     string
+		path    string
+		key     = []byte("0123456789abcdef0123456789abcdef")
+		subject CredentialCache
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iam-docker-cache")
+		Expect(err).To(BeNil())
+		path = filepath.Join(dir, "credentials")
+		subject, err = NewEncryptedFileCache(path, key)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	Describe("DecodeCacheKey", func() {
+		It("Decodes base64 keys", func() {
+			decoded, err := DecodeCacheKey(base64.StdEncoding.EncodeToString(key) + "\n")
+			Expect(err).To(BeNil())
+			Expect(decoded).To(Equal(key))
+		})
+
+		It("Rejects keys of the wrong size", func() {
+			_, err := DecodeCacheKey(base64.StdEncoding.EncodeToString(key[:16]))
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Rejects keys which aren't base64", func() {
+			_, err := DecodeCacheKey("not base64!")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("When the file does not exist", func() {
+		It("Loads no credentials", func() {
+			creds, err := subject.Load()
+			Expect(err).To(BeNil())
+			Expect(creds).To(BeEmpty())
+		})
+	})
+
+	Context("When credentials are saved", func() {
+		var (
+			accessKeyID     = "fakeaccesskeyid"
+			secretAccessKey = "fakesecretaccesskey"
+			sessionToken    = "fakesessiontoken"
+			expiration      = time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+			lastUpdated     = time.Now().UTC().Truncate(time.Second)
+			saved           = []CachedCredential{
+				{
+					Role: Role{
+						ARN:   "arn:aws:iam::012345678901:role/test",
+						Tags:  map[string]string{"team": "platform"},
+						Chain: []string{},
+					},
+					Credentials: &Credentials{
+						Credentials: &sts.Credentials{
+							AccessKeyId:     &accessKeyID,
+							SecretAccessKey: &secretAccessKey,
+							SessionToken:    &sessionToken,
+							Expiration:      &expiration,
+						},
+						LastUpdated: lastUpdated,
+					},
+				},
+			}
+		)
+
+		BeforeEach(func() {
+			Expect(subject.Save(saved)).To(BeNil())
+		})
+
+		It("Loads them", func() {
+			creds, err := subject.Load()
+			Expect(err).To(BeNil())
+			Expect(creds).To(Equal(saved))
+			Expect(creds[0].Role.Key()).To(Equal(saved[0].Role.Key()))
+		})
+
+		It("Encrypts them", func() {
+			content, err := ioutil.ReadFile(path)
+			Expect(err).To(BeNil())
+			Expect(string(content)).ToNot(ContainSubstring(secretAccessKey))
+		})
+
+		It("Restricts the file to its owner", func() {
+			info, err := os.Stat(path)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("Leaves no temporary files behind", func() {
+			Expect(subject.Save(saved)).To(BeNil())
+			entries, err := ioutil.ReadDir(dir)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+		})
+
+		It("Fails to load them with another key", func() {
+			other, err := NewEncryptedFileCache(path, []byte("fedcba9876543210fedcba9876543210"))
+			Expect(err).To(BeNil())
+			_, err = other.Load()
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,52 @@
+package iam
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"io/ioutil"
+	"time"
+)
+
+// NewFileSource creates a CredentialSource which issues the credentials of
+// roles from a JSON file, keyed by role ARN. The file is read each time
+// credentials are issued, so that it may be rewritten in place. Credentials
+// without an expiration are reissued after the requested session duration.
+func NewFileSource(path string) CredentialSource {
+	return &fileSource{path: path}
+}
+
+func (source *fileSource) CanChain() bool {
+	return false
+}
+
+func (source *fileSource) IssueCredentials(request *CredentialRequest) (*sts.Credentials, error) {
+	err := checkUnchainedRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(source.path)
+	if err != nil {
+		return nil, err
+	}
+	var credsByARN map[string]*sts.Credentials
+	err = json.Unmarshal(content, &credsByARN)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse credential file %s: %s", source.path, err.Error())
+	}
+
+	found, hasKey := credsByARN[request.Role.ARN]
+	if !hasKey || (found == nil) || (found.AccessKeyId == nil) || (found.SecretAccessKey == nil) {
+		return nil, fmt.Errorf("No credentials in %s for: %s", source.path, request.Role.ARN)
+	}
+	creds := *found
+	if creds.Expiration == nil {
+		creds.Expiration = aws.Time(time.Now().Add(request.Duration))
+	}
+	return &creds, nil
+}
+
+type fileSource struct {
+	path string
+}
@@ -0,0 +1,117 @@
+package iam_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/swipely/iam-docker/src/iam"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("FileSource", func() {
+	const (
+		role = "arn:aws:iam::012345678901:role/test"
+	)
+
+	var (
+		dir     string
+		path    string
+		subject CredentialSource
+		request *CredentialRequest
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iam-docker-source")
+		Expect(err).To(BeNil())
+		path = filepath.Join(dir, "credentials.json")
+		subject = NewFileSource(path)
+		request = &CredentialRequest{Role: &Role{ARN: role}, Duration: time.Hour}
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	Context("When the file does not exist", func() {
+		It("Returns an error", func() {
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("When the file has credentials for the role", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(path, []byte(`{
+				"arn:aws:iam::012345678901:role/test": {
+					"AccessKeyId": "fakeaccesskeyid",
+					"SecretAccessKey": "fakesecretaccesskey",
+					"SessionToken": "fakesessiontoken",
+					"Expiration": "2030-01-01T00:00:00Z"
+				},
+				"arn:aws:iam::012345678901:role/static": {
+					"AccessKeyId": "statickeyid",
+					"SecretAccessKey": "staticsecretaccesskey"
+				}
+			}`), 0600)).To(BeNil())
+		})
+
+		It("Returns them", func() {
+			creds, err := subject.IssueCredentials(request)
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal("fakeaccesskeyid"))
+			Expect(*creds.SecretAccessKey).To(Equal("fakesecretaccesskey"))
+			Expect(*creds.SessionToken).To(Equal("fakesessiontoken"))
+			Expect(*creds.Expiration).To(Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)))
+		})
+
+		It("Expires credentials without an expiration after the duration", func() {
+			request.Role.ARN = "arn:aws:iam::012345678901:role/static"
+			creds, err := subject.IssueCredentials(request)
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal("statickeyid"))
+			Expect(creds.Expiration.Sub(time.Now())).To(BeNumerically("~", time.Hour, time.Second))
+		})
+
+		It("Returns an error for other roles", func() {
+			request.Role.ARN = "arn:aws:iam::012345678901:role/other"
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Returns an error for requests which only STS supports", func() {
+			request.Role.Tags = map[string]string{"team": "platform"}
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			request.Role.Tags = nil
+			request.Role.SourceIdentity = "web"
+			_, err = subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			request.Role.SourceIdentity = ""
+			request.ExternalID = "vendor"
+			_, err = subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Reads the file each time", func() {
+			_, _ = subject.IssueCredentials(request)
+			Expect(ioutil.WriteFile(path, []byte(`{"arn:aws:iam::012345678901:role/test": {"AccessKeyId": "rotatedkeyid", "SecretAccessKey": "rotatedsecret"}}`), 0600)).To(BeNil())
+			creds, err := subject.IssueCredentials(request)
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal("rotatedkeyid"))
+		})
+	})
+
+	Context("When the file is invalid", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(path, []byte("not json"), 0600)).To(BeNil())
+		})
+
+		It("Returns an error", func() {
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package iam
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefreshWorkers = 4
+)
+
+// newRefreshScheduler creates a queue of refreshes ordered by when they're
+// due.
+func newRefreshScheduler() *refreshScheduler {
+	return &refreshScheduler{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// schedule queues the refresh, waking the scheduler in case it's due before
+// every other refresh.
+func (scheduler *refreshScheduler) schedule(refresh *scheduledRefresh) {
+	scheduler.mutex.Lock()
+	heap.Push(&scheduler.queue, refresh)
+	scheduler.mutex.Unlock()
+
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends each refresh to one of the workers once it's due, until stop is
+// closed. Refreshes which are due while every worker is busy wait for the
+// next free worker.
+func (scheduler *refreshScheduler) run(stop <-chan struct{}, workers int, refresh func(*scheduledRefresh)) {
+	if workers <= 0 {
+		workers = defaultRefreshWorkers
+	}
+	jobs := make(chan *scheduledRefresh)
+	var group sync.WaitGroup
+	group.Add(workers)
+	for idx := 0; idx < workers; idx++ {
+		go func() {
+			defer group.Done()
+			for job := range jobs {
+				refresh(job)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		group.Wait()
+	}()
+
+	for {
+		due := scheduler.next()
+		if due != nil {
+			select {
+			case jobs <- due:
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		timer := time.NewTimer(scheduler.wait())
+		select {
+		case <-timer.C:
+		case <-scheduler.wake:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// next removes and returns the earliest refresh if it's due.
+func (scheduler *refreshScheduler) next() *scheduledRefresh {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if (len(scheduler.queue) == 0) || time.Now().Before(scheduler.queue[0].at) {
+		return nil
+	}
+	return heap.Pop(&scheduler.queue).(*scheduledRefresh)
+}
+
+// wait returns how long until the earliest refresh is due. When nothing is
+// queued, the scheduler waits until it's woken.
+func (scheduler *refreshScheduler) wait() time.Duration {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if len(scheduler.queue) == 0 {
+		return time.Hour
+	}
+	return scheduler.queue[0].at.Sub(time.Now())
+}
+
+type scheduledRefresh struct {
+	key         string
+	at          time.Time
+	credentials *Credentials
+	gracePeriod time.Duration
+}
+
+type refreshQueue []*scheduledRefresh
+
+func (queue refreshQueue) Len() int           { return len(queue) }
+func (queue refreshQueue) Swap(i, j int)      { queue[i], queue[j] = queue[j], queue[i] }
+func (queue refreshQueue) Less(i, j int) bool { return queue[i].at.Before(queue[j].at) }
+
+func (queue *refreshQueue) Push(refresh interface{}) {
+	*queue = append(*queue, refresh.(*scheduledRefresh))
+}
+
+func (queue *refreshQueue) Pop() interface{} {
+	old := *queue
+	last := len(old) - 1
+	refresh := old[last]
+	old[last] = nil
+	*queue = old[:last]
+	return refresh
+}
+
+type refreshScheduler struct {
+	queue refreshQueue
+	wake  chan struct{}
+	mutex sync.Mutex
+}
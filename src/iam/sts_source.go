@@ -0,0 +1,89 @@
+package iam
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"sort"
+	"time"
+)
+
+// NewSTSSource creates a CredentialSource which assumes roles with STS. The
+// chained client factory is used to assume roles with the credentials of
+// another role; when nil, roles cannot be chained.
+func NewSTSSource(client STSClient, chainedClient STSClientFactory) CredentialSource {
+	return &stsSource{
+		client:        client,
+		chainedClient: chainedClient,
+	}
+}
+
+func (source *stsSource) CanChain() bool {
+	return source.chainedClient != nil
+}
+
+func (source *stsSource) IssueCredentials(request *CredentialRequest) (*sts.Credentials, error) {
+	client := source.client
+	if request.Parent != nil {
+		if source.chainedClient == nil {
+			return nil, fmt.Errorf("Role chaining is not configured, unable to assume: %s", request.Role.ARN)
+		}
+		client = source.chainedClient(request.Parent)
+	}
+
+	output, err := client.AssumeRole(assumeRoleInput(request))
+	if err != nil {
+		return nil, err
+	} else if output.Credentials == nil {
+		return nil, fmt.Errorf("No credentials returned for: %s", request.Role.ARN)
+	}
+	return output.Credentials, nil
+}
+
+// assumeRoleInput builds the request to assume the role.
+func assumeRoleInput(request *CredentialRequest) *sts.AssumeRoleInput {
+	role := request.Role
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(role.ARN),
+		DurationSeconds: aws.Int64(int64(request.Duration / time.Second)),
+		RoleSessionName: aws.String(request.SessionName),
+	}
+
+	if request.ExternalID != "" {
+		input.ExternalId = aws.String(request.ExternalID)
+	}
+
+	if len(role.Tags) > 0 {
+		keys := make([]string, 0, len(role.Tags))
+		for key := range role.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		input.Tags = make([]*sts.Tag, len(keys))
+		for idx, key := range keys {
+			input.Tags[idx] = &sts.Tag{Key: aws.String(key), Value: aws.String(role.Tags[key])}
+		}
+		input.TransitiveTagKeys = aws.StringSlice(role.TransitiveTagKeys)
+	}
+
+	if role.SourceIdentity != "" {
+		input.SourceIdentity = aws.String(role.SourceIdentity)
+	}
+
+	if role.Policy != "" {
+		input.Policy = aws.String(role.Policy)
+	}
+	if len(role.PolicyARNs) > 0 {
+		input.PolicyArns = make([]*sts.PolicyDescriptorType, len(role.PolicyARNs))
+		for idx, policyARN := range role.PolicyARNs {
+			input.PolicyArns[idx] = &sts.PolicyDescriptorType{Arn: aws.String(policyARN)}
+		}
+	}
+
+	return input
+}
+
+type stsSource struct {
+	client        STSClient
+	chainedClient STSClientFactory
+}
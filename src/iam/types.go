@@ -1,19 +1,196 @@
 package iam
 
 import (
+	"encoding/json"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"net/http"
+	"time"
 )
 
 // STSClient specifies the subset of STS API calls used by the CredentialStore.
 type STSClient interface {
 	AssumeRole(*sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error)
+	AssumeRoleWithWebIdentity(*sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// STSClientFactory creates an STSClient which signs its requests with the given
+// credentials, to assume the next role in a chain.
+type STSClientFactory func(creds *sts.Credentials) STSClient
+
+// CredentialSource issues the credentials of roles, such as by assuming them
+// with STS.
+type CredentialSource interface {
+	// Issue credentials for the role described by the request.
+	IssueCredentials(request *CredentialRequest) (*sts.Credentials, error)
+	// Whether roles may be issued with the credentials of another role.
+	CanChain() bool
+}
+
+// CredentialRequest describes the credentials which are issued for a role.
+type CredentialRequest struct {
+	Role *Role
+	// Duration is the requested session duration, which sources may ignore.
+	Duration time.Duration
+	// SessionName identifies the session, and is always set.
+	SessionName string
+	// ExternalID is the resolved external ID of the role, if any.
+	ExternalID string
+	// Parent is the credentials of the previous role in the chain, when the
+	// role is chained.
+	Parent *sts.Credentials
 }
 
 // CredentialStore caches IAM credentials and can refresh those which are going
 // stale.
 type CredentialStore interface {
-	// Lookup the credentials for the given ARN.
-	CredentialsForRole(arn string) (*sts.Credentials, error)
-	// Refresh all the credentials that are expired or are about to expire.
-	RefreshCredentials()
+	// Lookup the credentials for the given role.
+	CredentialsForRole(role *Role) (*Credentials, error)
+	// Refresh each credential at a random point before it expires, until stop
+	// is closed.
+	RunRefreshScheduler(stop <-chan struct{})
+	// Mark the given roles as in use, and evict the credentials of roles
+	// which have been idle for longer than the configured timeout.
+	ReconcileRoles(roles []*Role)
+	// List the roles which could not be assumed, and when they'll be retried.
+	Failures() []Failure
+}
+
+// CredentialCache persists credentials, so that they survive restarts.
+type CredentialCache interface {
+	// Load every persisted credential.
+	Load() ([]CachedCredential, error)
+	// Replace the persisted credentials with the given ones.
+	Save(creds []CachedCredential) error
+}
+
+// Role describes how an IAM role is assumed. Containers which assume the same
+// role in the same way share credentials.
+type Role struct {
+	ARN string
+	// Duration is the requested session duration. When zero, the store's
+	// default is used.
+	Duration time.Duration
+	// ExternalID is required by the trust policy of some third-party roles.
+	// When empty, the store's configured external ID for the ARN is used.
+	ExternalID string
+	// Tags are the session tags, by key.
+	Tags map[string]string
+	// TransitiveTagKeys are the keys of the session tags which persist when
+	// the session assumes another role.
+	TransitiveTagKeys []string
+	// Policy is a JSON session policy which scopes down the role's
+	// permissions.
+	Policy string
+	// PolicyARNs are managed policies which scope down the role's
+	// permissions.
+	PolicyARNs []string
+	// SessionName identifies the session in CloudTrail. When empty, a random
+	// name is generated.
+	SessionName string
+	// SourceIdentity identifies the workload which assumed the role, and
+	// persists through role chaining.
+	SourceIdentity string
+	// Chain is the ARNs of the intermediate roles which are assumed in order
+	// before this role, each with the credentials of the previous one. When
+	// nil, the store's configured chain for the ARN is used, while an empty
+	// chain is always assumed directly.
+	Chain []string
+}
+
+// Credentials are the assumed credentials of a role, along with when they were
+// issued.
+type Credentials struct {
+	*sts.Credentials
+	LastUpdated time.Time
+}
+
+// CachedCredential is a credential persisted by a CredentialCache, along with
+// the role it was assumed for.
+type CachedCredential struct {
+	Role Role
+	// Requested is the role before the store's configured external ID and
+	// chain were filled in.
+	Requested   Role
+	Credentials *Credentials
+}
+
+// Failure describes a role which could not be assumed. Until RetryAt, requests
+// for the role fail with the same error without calling STS.
+type Failure struct {
+	ARN         string
+	Class       string
+	Error       string
+	Count       int
+	LastAttempt time.Time
+	RetryAt     time.Time
+}
+
+// Config holds the configuration of the CredentialStore.
+type Config struct {
+	// DefaultDuration is the session duration of roles which don't request
+	// their own. When zero, sessions last one hour.
+	DefaultDuration time.Duration
+	// ExternalIDs are the external IDs of roles, by ARN, which are used when
+	// the role doesn't specify its own.
+	ExternalIDs map[string]string
+	// Chains are the intermediate roles of roles, by ARN, which are used when
+	// the role doesn't specify its own.
+	Chains map[string][]string
+	// ChainedClient creates the clients which assume roles after the first in
+	// a chain, when the store is created with an STSClient. When nil, roles
+	// cannot be chained.
+	ChainedClient STSClientFactory
+	// MinFailureBackoff is the shortest time a role which could not be assumed
+	// is backed off for, before it's scaled by the class of the error. When
+	// zero, it's one second.
+	MinFailureBackoff time.Duration
+	// MaxFailureBackoff is the longest time a role which could not be assumed
+	// is backed off for. When zero, it's five minutes.
+	MaxFailureBackoff time.Duration
+	// IdleTimeout is how long the credentials of a role are kept after it was
+	// last requested or reconciled. When zero, credentials are never evicted.
+	IdleTimeout time.Duration
+	// RefreshWorkers is the number of scheduled refreshes which may run at
+	// once. When zero, it's four.
+	RefreshWorkers int
+	// Cache persists credentials whenever they change, and the credentials
+	// which are still fresh are loaded from it when the store is created.
+	// When nil, credentials are only kept in memory.
+	Cache CredentialCache
+	// CacheSaveDelay is how long changes are batched before they're written to
+	// the cache. When zero, it's one second.
+	CacheSaveDelay time.Duration
+}
+
+// VaultConfig configures the source of credentials issued by the AWS secrets
+// engine of HashiCorp Vault.
+type VaultConfig struct {
+	// Address of the Vault server, such as https://vault.example.com:8200.
+	Address string
+	// Token authenticates requests to Vault.
+	Token string
+	// TokenFile holds the token, and is read before each request in place of
+	// Token when set.
+	TokenFile string
+	// Namespace is the Vault Enterprise namespace of the secrets engine.
+	Namespace string
+	// Mount is the path of the secrets engine. When empty, it's "aws".
+	Mount string
+	// Roles are the names of the Vault roles which issue IAM roles, by ARN.
+	// Roles which aren't listed are issued by the Vault role with the same
+	// name as the IAM role.
+	Roles map[string]string
+	// Client sends requests to Vault. When nil, requests time out after ten
+	// seconds.
+	Client *http.Client
+}
+
+// Key identifies the role's credentials. Roles with the same key may share
+// credentials.
+func (role *Role) Key() string {
+	key, err := json.Marshal(role)
+	if err != nil {
+		return role.ARN
+	}
+	return string(key)
 }
@@ -0,0 +1,211 @@
+package iam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVaultMount   = "aws"
+	defaultVaultTimeout = time.Second * 10
+	vaultTokenHeader    = "X-Vault-Token"
+	vaultNSHeader       = "X-Vault-Namespace"
+)
+
+// NewVaultSource creates a CredentialSource which issues credentials with the
+// AWS secrets engine of HashiCorp Vault. Each role is issued by the Vault role
+// of the same name as the IAM role, unless the config maps its ARN to another.
+func NewVaultSource(config *VaultConfig) (CredentialSource, error) {
+	address, err := url.Parse(config.Address)
+	if err != nil {
+		return nil, err
+	} else if (address.Scheme == "") || (address.Host == "") {
+		return nil, fmt.Errorf("Invalid Vault address: %s", config.Address)
+	} else if (config.Token == "") && (config.TokenFile == "") {
+		return nil, fmt.Errorf("Either a Vault token or token file is required")
+	}
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultVaultTimeout}
+	}
+	mount := strings.Trim(config.Mount, "/")
+	if mount == "" {
+		mount = defaultVaultMount
+	}
+	return &vaultSource{
+		address: strings.TrimSuffix(address.String(), "/"),
+		mount:   mount,
+		config:  config,
+		client:  client,
+	}, nil
+}
+
+func (source *vaultSource) CanChain() bool {
+	return false
+}
+
+func (source *vaultSource) IssueCredentials(request *CredentialRequest) (*sts.Credentials, error) {
+	err := checkUnchainedRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	token, err := source.token()
+	if err != nil {
+		return nil, err
+	}
+
+	name := source.vaultRole(request.Role.ARN)
+	body, err := json.Marshal(&vaultSTSRequest{
+		RoleARN:         request.Role.ARN,
+		RoleSessionName: request.SessionName,
+		TTL:             fmt.Sprintf("%ds", int64(request.Duration/time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s/sts/%s", source.address, source.mount, url.PathEscape(name))
+	httpRequest, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set(vaultTokenHeader, token)
+	if source.config.Namespace != "" {
+		httpRequest.Header.Set(vaultNSHeader, source.config.Namespace)
+	}
+
+	issuedAt := time.Now()
+	response, err := source.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret vaultSecret
+	err = json.Unmarshal(content, &secret)
+	if (err != nil) && (response.StatusCode == http.StatusOK) {
+		return nil, fmt.Errorf("Unable to parse Vault response for %s: %s", name, err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, vaultError(response.StatusCode, name, secret.Errors)
+	}
+
+	data := secret.Data
+	sessionToken := data.SessionToken
+	if sessionToken == "" {
+		sessionToken = data.SecurityToken
+	}
+	if (data.AccessKey == "") || (data.SecretKey == "") || (secret.LeaseDuration <= 0) {
+		return nil, fmt.Errorf("No credentials returned by Vault for: %s", name)
+	}
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String(data.AccessKey),
+		SecretAccessKey: aws.String(data.SecretKey),
+		Expiration:      aws.Time(issuedAt.Add(time.Duration(secret.LeaseDuration) * time.Second)),
+	}
+	if sessionToken != "" {
+		creds.SessionToken = aws.String(sessionToken)
+	}
+	return creds, nil
+}
+
+// token returns the configured token, reading the token file each time so that
+// tokens which are renewed by an agent are picked up.
+func (source *vaultSource) token() (string, error) {
+	if source.config.TokenFile == "" {
+		return source.config.Token, nil
+	}
+	content, err := ioutil.ReadFile(source.config.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("Vault token file is empty: %s", source.config.TokenFile)
+	}
+	return token, nil
+}
+
+// vaultRole determines the name of the Vault role which issues the IAM role.
+func (source *vaultSource) vaultRole(arn string) string {
+	if name, hasKey := source.config.Roles[arn]; hasKey {
+		return name
+	}
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// vaultError converts an error response into an awserr.Error, so that it's
+// classified like the equivalent error from STS.
+func vaultError(status int, name string, errors []string) error {
+	code := "VaultError"
+	switch {
+	case (status == http.StatusUnauthorized) || (status == http.StatusForbidden):
+		code = "AccessDenied"
+	case status == http.StatusBadRequest:
+		code = "ValidationError"
+	case status == http.StatusTooManyRequests:
+		code = "Throttling"
+	}
+	message := fmt.Sprintf("Vault returned %d for %s", status, name)
+	if len(errors) > 0 {
+		message = fmt.Sprintf("%s: %s", message, strings.Join(errors, "; "))
+	}
+	return awserr.New(code, message, nil)
+}
+
+// checkUnchainedRequest returns an error when the request can only be issued
+// by STS. Session policies are refused rather than ignored, since ignoring
+// them would grant more than the container asked for, as are session tags,
+// source identities and external IDs, which policies and audits rely on.
+func checkUnchainedRequest(request *CredentialRequest) error {
+	role := request.Role
+	if request.Parent != nil {
+		return fmt.Errorf("Role chaining is not supported, unable to issue: %s", role.ARN)
+	} else if (role.Policy != "") || (len(role.PolicyARNs) > 0) {
+		return fmt.Errorf("Session policies are not supported, unable to issue: %s", role.ARN)
+	} else if (len(role.Tags) > 0) || (len(role.TransitiveTagKeys) > 0) {
+		return fmt.Errorf("Session tags are not supported, unable to issue: %s", role.ARN)
+	} else if role.SourceIdentity != "" {
+		return fmt.Errorf("Source identities are not supported, unable to issue: %s", role.ARN)
+	} else if request.ExternalID != "" {
+		return fmt.Errorf("External IDs are not supported, unable to issue: %s", role.ARN)
+	}
+	return nil
+}
+
+type vaultSTSRequest struct {
+	RoleARN         string `json:"role_arn"`
+	RoleSessionName string `json:"role_session_name,omitempty"`
+	TTL             string `json:"ttl,omitempty"`
+}
+
+type vaultSecret struct {
+	LeaseDuration int64 `json:"lease_duration"`
+	Data          struct {
+		AccessKey     string `json:"access_key"`
+		SecretKey     string `json:"secret_key"`
+		SecurityToken string `json:"security_token"`
+		SessionToken  string `json:"session_token"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+type vaultSource struct {
+	address string
+	mount   string
+	config  *VaultConfig
+	client  *http.Client
+}
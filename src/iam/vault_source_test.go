@@ -0,0 +1,226 @@
+package iam_test
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/swipely/iam-docker/src/iam"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("VaultSource", func() {
+	const (
+		role  = "arn:aws:iam::012345678901:role/test-role"
+		token = "s.faketoken"
+	)
+
+	var (
+		server   *httptest.Server
+		status   int
+		response string
+		paths    []string
+		headers  []http.Header
+		bodies   []map[string]string
+		config   *VaultConfig
+		subject  CredentialSource
+		request  *CredentialRequest
+	)
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		response = `{"lease_duration": 900, "data": {"access_key": "fakeaccesskeyid", "secret_key": "fakesecretaccesskey", "security_token": "fakesessiontoken"}}`
+		paths = nil
+		headers = nil
+		bodies = nil
+		server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, httpRequest *http.Request) {
+			body := make(map[string]string)
+			_ = json.NewDecoder(httpRequest.Body).Decode(&body)
+			paths = append(paths, httpRequest.Method+" "+httpRequest.URL.Path)
+			headers = append(headers, httpRequest.Header)
+			bodies = append(bodies, body)
+			writer.WriteHeader(status)
+			_, _ = writer.Write([]byte(response))
+		}))
+		config = &VaultConfig{Address: server.URL, Token: token}
+		request = &CredentialRequest{
+			Role:        &Role{ARN: role},
+			Duration:    15 * time.Minute,
+			SessionName: "test-session",
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		subject, err = NewVaultSource(config)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("NewVaultSource", func() {
+		It("Requires an address", func() {
+			_, err := NewVaultSource(&VaultConfig{Token: token})
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("Requires a token", func() {
+			_, err := NewVaultSource(&VaultConfig{Address: server.URL})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("When Vault issues the credentials", func() {
+		It("Returns them", func() {
+			before := time.Now()
+			creds, err := subject.IssueCredentials(request)
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal("fakeaccesskeyid"))
+			Expect(*creds.SecretAccessKey).To(Equal("fakesecretaccesskey"))
+			Expect(*creds.SessionToken).To(Equal("fakesessiontoken"))
+			Expect(creds.Expiration.Sub(before)).To(BeNumerically("~", 15*time.Minute, time.Second))
+		})
+
+		It("Requests them from the Vault role with the same name", func() {
+			_, _ = subject.IssueCredentials(request)
+			Expect(paths).To(Equal([]string{"POST /v1/aws/sts/test-role"}))
+			Expect(headers[0].Get("X-Vault-Token")).To(Equal(token))
+			Expect(bodies[0]).To(Equal(map[string]string{
+				"role_arn":          role,
+				"role_session_name": "test-session",
+				"ttl":               "900s",
+			}))
+		})
+
+		It("Accepts the session token under its newer name", func() {
+			response = `{"lease_duration": 900, "data": {"access_key": "fakeaccesskeyid", "secret_key": "fakesecretaccesskey", "session_token": "newsessiontoken"}}`
+			creds, err := subject.IssueCredentials(request)
+			Expect(err).To(BeNil())
+			Expect(*creds.SessionToken).To(Equal("newsessiontoken"))
+		})
+
+		Context("With a mapped role, mount and namespace", func() {
+			BeforeEach(func() {
+				config.Roles = map[string]string{role: "mapped"}
+				config.Mount = "/aws-prod/"
+				config.Namespace = "platform"
+			})
+
+			It("Requests them from the mapped role", func() {
+				_, _ = subject.IssueCredentials(request)
+				Expect(paths).To(Equal([]string{"POST /v1/aws-prod/sts/mapped"}))
+				Expect(headers[0].Get("X-Vault-Namespace")).To(Equal("platform"))
+			})
+		})
+
+		Context("With a token file", func() {
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "iam-docker-vault")
+				Expect(err).To(BeNil())
+				config.TokenFile = filepath.Join(dir, "token")
+				Expect(ioutil.WriteFile(config.TokenFile, []byte("s.filetoken\n"), 0600)).To(BeNil())
+			})
+
+			AfterEach(func() {
+				_ = os.RemoveAll(dir)
+			})
+
+			It("Reads the token before each request", func() {
+				_, _ = subject.IssueCredentials(request)
+				Expect(ioutil.WriteFile(config.TokenFile, []byte("s.rotatedtoken"), 0600)).To(BeNil())
+				_, _ = subject.IssueCredentials(request)
+				Expect(headers[0].Get("X-Vault-Token")).To(Equal("s.filetoken"))
+				Expect(headers[1].Get("X-Vault-Token")).To(Equal("s.rotatedtoken"))
+			})
+		})
+	})
+
+	Context("When Vault denies the request", func() {
+		BeforeEach(func() {
+			status = http.StatusForbidden
+			response = `{"errors": ["permission denied"]}`
+		})
+
+		It("Returns an error which is classified as access denied", func() {
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			Expect(err.(awserr.Error).Code()).To(Equal("AccessDenied"))
+			Expect(err.Error()).To(ContainSubstring("permission denied"))
+		})
+	})
+
+	Context("When Vault returns no credentials", func() {
+		BeforeEach(func() {
+			response = `{"lease_duration": 900, "data": {}}`
+		})
+
+		It("Returns an error", func() {
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("When the request has a session policy", func() {
+		It("Returns an error without calling Vault", func() {
+			request.Role.Policy = `{"Version":"2012-10-17"}`
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			Expect(paths).To(BeEmpty())
+		})
+	})
+
+	Context("When the request has session tags", func() {
+		It("Returns an error without calling Vault", func() {
+			request.Role.Tags = map[string]string{"team": "platform"}
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			Expect(paths).To(BeEmpty())
+		})
+	})
+
+	Context("When the request has a source identity", func() {
+		It("Returns an error without calling Vault", func() {
+			request.Role.SourceIdentity = "web"
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			Expect(paths).To(BeEmpty())
+		})
+	})
+
+	Context("When the request has an external ID", func() {
+		It("Returns an error without calling Vault", func() {
+			request.ExternalID = "vendor"
+			_, err := subject.IssueCredentials(request)
+			Expect(err).ToNot(BeNil())
+			Expect(paths).To(BeEmpty())
+		})
+	})
+
+	Context("Behind a credential store", func() {
+		It("Caches the credentials", func() {
+			store := NewCredentialStoreFromSource(subject, 1, &Config{})
+			creds, err := store.CredentialsForRole(&Role{ARN: role})
+			Expect(err).To(BeNil())
+			Expect(*creds.AccessKeyId).To(Equal("fakeaccesskeyid"))
+			_, _ = store.CredentialsForRole(&Role{ARN: role})
+			Expect(paths).To(HaveLen(1))
+		})
+
+		It("Refuses to chain roles", func() {
+			store := NewCredentialStoreFromSource(subject, 1, &Config{})
+			_, err := store.CredentialsForRole(&Role{ARN: role, Chain: []string{"arn:aws:iam::012345678901:role/broker"}})
+			Expect(err).ToNot(BeNil())
+			Expect(paths).To(BeEmpty())
+		})
+	})
+})
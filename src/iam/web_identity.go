@@ -0,0 +1,80 @@
+package iam
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	// WebIdentityProviderName identifies credentials retrieved by the
+	// WebIdentityProvider.
+	WebIdentityProviderName = "IAMDockerWebIdentityProvider"
+	webIdentityExpiryWindow = time.Minute * 5
+)
+
+// NewWebIdentityProvider creates a credentials.Provider which assumes the role
+// with the OIDC token in the token file, for use as the base identity which
+// assumes the roles of containers. The token file is read each time the
+// credentials are retrieved, so that rotated tokens are picked up. The client
+// doesn't need credentials of its own.
+func NewWebIdentityProvider(client STSClient, roleARN string, tokenFile string, sessionName string) *WebIdentityProvider {
+	return &WebIdentityProvider{
+		client:      client,
+		roleARN:     roleARN,
+		tokenFile:   tokenFile,
+		sessionName: sessionName,
+	}
+}
+
+// Retrieve implements credentials.Provider.
+func (provider *WebIdentityProvider) Retrieve() (credentials.Value, error) {
+	value := credentials.Value{ProviderName: WebIdentityProviderName}
+	content, err := ioutil.ReadFile(provider.tokenFile)
+	if err != nil {
+		return value, err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return value, fmt.Errorf("Web identity token file is empty: %s", provider.tokenFile)
+	}
+
+	output, err := provider.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(provider.roleARN),
+		RoleSessionName:  aws.String(provider.sessionName),
+		WebIdentityToken: aws.String(token),
+	})
+	if err != nil {
+		return value, err
+	} else if output.Credentials == nil {
+		return value, fmt.Errorf("No credentials returned for: %s", provider.roleARN)
+	}
+
+	creds := output.Credentials
+	if creds.Expiration != nil {
+		provider.SetExpiration(*creds.Expiration, webIdentityExpiryWindow)
+	}
+	log.WithFields(logrus.Fields{
+		"arn":        provider.roleARN,
+		"expiration": aws.TimeValue(creds.Expiration).Format(time.RFC3339),
+	}).Info("Assumed base identity with web identity token")
+	value.AccessKeyID = aws.StringValue(creds.AccessKeyId)
+	value.SecretAccessKey = aws.StringValue(creds.SecretAccessKey)
+	value.SessionToken = aws.StringValue(creds.SessionToken)
+	return value, nil
+}
+
+// WebIdentityProvider retrieves the base identity's credentials by assuming a
+// role with an OIDC token.
+type WebIdentityProvider struct {
+	credentials.Expiry
+	client      STSClient
+	roleARN     string
+	tokenFile   string
+	sessionName string
+}
@@ -0,0 +1,106 @@
+package iam_test
+
+import (
+	"github.com/aws/aws-sdk-go/service/sts"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/swipely/iam-docker/src/iam"
+	"github.com/swipely/iam-docker/src/mock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("WebIdentityProvider", func() {
+	const (
+		role        = "arn:aws:iam::012345678901:role/build-farm"
+		sessionName = "iam-docker"
+	)
+
+	var (
+		dir             string
+		tokenFile       string
+		client          *mock.STSClient
+		subject         *WebIdentityProvider
+		accessKeyID     = "fakeaccesskeyid"
+		secretAccessKey = "fakesecretaccesskey"
+		sessionToken    = "fakesessiontoken"
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "iam-docker-web-identity")
+		Expect(err).To(BeNil())
+		tokenFile = filepath.Join(dir, "token")
+		Expect(ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600)).To(BeNil())
+		client = mock.NewSTSClient()
+		expiration := time.Now().Add(time.Hour)
+		client.AssumableRoles[role] = &sts.Credentials{
+			AccessKeyId:     &accessKeyID,
+			SecretAccessKey: &secretAccessKey,
+			SessionToken:    &sessionToken,
+			Expiration:      &expiration,
+		}
+		subject = NewWebIdentityProvider(client, role, tokenFile, sessionName)
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	Context("When the role can be assumed", func() {
+		It("Returns its credentials", func() {
+			value, err := subject.Retrieve()
+			Expect(err).To(BeNil())
+			Expect(value.AccessKeyID).To(Equal(accessKeyID))
+			Expect(value.SecretAccessKey).To(Equal(secretAccessKey))
+			Expect(value.SessionToken).To(Equal(sessionToken))
+			Expect(value.ProviderName).To(Equal(WebIdentityProviderName))
+		})
+
+		It("Assumes the role with the token", func() {
+			_, _ = subject.Retrieve()
+			Expect(client.WebIdentityInputs).To(HaveLen(1))
+			input := client.WebIdentityInputs[0]
+			Expect(*input.RoleArn).To(Equal(role))
+			Expect(*input.RoleSessionName).To(Equal(sessionName))
+			Expect(*input.WebIdentityToken).To(Equal("first-token"))
+		})
+
+		It("Expires before the credentials do", func() {
+			Expect(subject.IsExpired()).To(BeTrue())
+			_, _ = subject.Retrieve()
+			Expect(subject.IsExpired()).To(BeFalse())
+			expiration := time.Now().Add(time.Minute)
+			client.AssumableRoles[role].Expiration = &expiration
+			_, _ = subject.Retrieve()
+			Expect(subject.IsExpired()).To(BeTrue())
+		})
+
+		It("Reads the rotated token", func() {
+			_, _ = subject.Retrieve()
+			Expect(ioutil.WriteFile(tokenFile, []byte("second-token"), 0600)).To(BeNil())
+			_, _ = subject.Retrieve()
+			Expect(client.WebIdentityInputs).To(HaveLen(2))
+			Expect(*client.WebIdentityInputs[1].WebIdentityToken).To(Equal("second-token"))
+		})
+	})
+
+	Context("When the token file is empty", func() {
+		It("Returns an error without calling STS", func() {
+			Expect(ioutil.WriteFile(tokenFile, []byte("\n"), 0600)).To(BeNil())
+			_, err := subject.Retrieve()
+			Expect(err).ToNot(BeNil())
+			Expect(client.WebIdentityInputs).To(BeEmpty())
+		})
+	})
+
+	Context("When the role can't be assumed", func() {
+		It("Returns an error", func() {
+			delete(client.AssumableRoles, role)
+			_, err := subject.Retrieve()
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
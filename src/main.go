@@ -1,27 +1,94 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"flag"
+	"fmt"
 	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/swipely/iam-docker/src/app"
+	iamDocker "github.com/swipely/iam-docker/src/docker"
+	"github.com/swipely/iam-docker/src/iam"
 	iamLog "github.com/swipely/iam-docker/src/log"
+	iamMetadata "github.com/swipely/iam-docker/src/metadata"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"text/template"
 	"time"
 )
 
+const (
+	cacheKeyEnv           = "IAM_DOCKER_CREDENTIAL_CACHE_KEY"
+	credentialsIDKeyBytes = 32
+)
+
+var (
+	accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+	partitions       = map[string]bool{"aws": true, "aws-cn": true, "aws-us-gov": true}
+)
+
 var (
 	listenAddr              = flag.String("listen-addr", ":8080", "Address on which the HTTP server should listen")
+	diagnosticsAddr         = flag.String("diagnostics-addr", "", "Address on which credential diagnostics are served; default is disabled")
 	readTimeout             = flag.Duration("read-timeout", time.Minute, "Read timeout of the HTTP server")
 	writeTimeout            = flag.Duration("write-timeout", time.Minute, "Write timeout of the HTTP server")
 	metadata                = flag.String("meta-data-api", "http://169.254.169.254:80", "Address of the EC2 MetaData API")
 	eventHandlers           = flag.Int("event-handlers", 4, "Number of workers listening to the Docker Events channel")
 	dockerSyncPeriod        = flag.Duration("docker-sync-period", 0*time.Second, "Frequency of Docker Container sync; default is never")
-	credentialRefreshPeriod = flag.Duration("credential-refresh-period", time.Minute, "Frequency of the IAM credential sync")
+	credentialRefreshPeriod = flag.Duration("credential-refresh-period", time.Minute, "Frequency of reconciling IAM credentials with the running containers")
+	stsRegion               = flag.String("sts-region", "", "Region of the STS endpoint; default is the region of the environment or profile, or us-east-1")
+	stsEndpointType         = flag.String("sts-endpoint-type", "", "Whether the global or regional STS endpoint is used; default is the SDK's, or $AWS_STS_REGIONAL_ENDPOINTS")
+	stsEndpoint             = flag.String("sts-endpoint", "", "URL of the STS endpoint, e.g. of a VPC endpoint or LocalStack; default is AWS's")
+	awsProfile              = flag.String("aws-profile", "", "Shared config profile of the base identity which assumes roles; default is $AWS_PROFILE")
+	awsCredentialsFile      = flag.String("aws-credentials-file", "", "Shared credentials file of the base identity which assumes roles, read along with the shared config file; default is the SDK's")
+	webIdentityRoleARN      = flag.String("web-identity-role-arn", os.Getenv("AWS_ROLE_ARN"), "Role which the base identity assumes with a web identity token; default is $AWS_ROLE_ARN")
+	webIdentityTokenFile    = flag.String("web-identity-token-file", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), "Path of the web identity token, which is read whenever the role is assumed; default is $AWS_WEB_IDENTITY_TOKEN_FILE")
+	webIdentitySessionName  = flag.String("web-identity-session-name", "iam-docker", "Session name of the role assumed with a web identity token")
+	credentialSource        = flag.String("credential-source", "sts", "Source of IAM credentials: sts, vault or file")
+	credentialFile          = flag.String("credential-file", "", "Path of the JSON file of credentials by role ARN, when the credential source is file")
+	vaultAddr               = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Address of Vault, when the credential source is vault; default is $VAULT_ADDR")
+	vaultTokenFile          = flag.String("vault-token-file", "", "Path of the Vault token, which is read before each request; default is $VAULT_TOKEN")
+	vaultNamespace          = flag.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace of the AWS secrets engine; default is $VAULT_NAMESPACE")
+	vaultMount              = flag.String("vault-mount", "aws", "Path at which Vault's AWS secrets engine is mounted")
+	vaultRoles              = flag.String("vault-roles", "", "Comma-separated <role ARN>=<Vault role> pairs; default is the Vault role named after the IAM role")
+	vaultCACert             = flag.String("vault-ca-cert", os.Getenv("VAULT_CACERT"), "Path of the CA certificate which signed Vault's certificate; default is $VAULT_CACERT")
+	credentialCache         = flag.String("credential-cache", "", "Path of an encrypted file which persists IAM credentials across restarts; default is none")
+	credentialCacheKeyFile  = flag.String("credential-cache-key-file", "", "Path of the base64 encoded 256 bit key of the credential cache; default is $"+cacheKeyEnv)
+	refreshWorkers          = flag.Int("refresh-workers", 4, "Number of IAM credentials which may be refreshed at once")
+	credentialIdleTimeout   = flag.Duration("credential-idle-timeout", time.Hour, "How long credentials of roles which no running container uses are kept; 0 keeps them forever")
+	defaultAccount          = flag.String("default-account", "", "Account ID of roles which containers give by name rather than ARN; default is full ARNs only")
+	defaultPartition        = flag.String("default-partition", "aws", "Partition of roles which containers give by name: aws, aws-cn or aws-us-gov")
+	sessionDuration         = flag.Duration("session-duration", time.Hour, "Default duration of assumed role sessions, capped by each role's maximum")
+	externalIDs             = pairsFlag("external-id", "External ID used when assuming a third-party role, as <role ARN>=<external ID>; may be repeated")
+	sessionTagLabels        = flag.String("session-tag-labels", "", "Comma-separated container labels passed as session tags, optionally as <label>=<tag key>")
+	transitiveTagKeys       = flag.String("transitive-tag-keys", "", "Comma-separated session tag keys which persist through role chaining")
+	sessionPolicyDir        = flag.String("session-policy-dir", "", "Directory of session policy files which containers may reference by name")
+	sessionNameTemplate     = flag.String("session-name-template", "", "Template of role session names, e.g. '{{.Name}}@{{.Host}}'; default is random")
+	sourceIdentityTemplate  = flag.String("source-identity-template", "", "Template of the source identity set when assuming roles; default is none")
+	roleChains              = flag.String("role-chains", "", "Comma-separated <role ARN>=<intermediate ARN>[|<intermediate ARN>...] chains assumed before the role")
 	disableUpstream         = flag.Bool("disable-upstream", false, "Whether non-IAM metadata requests should be reverse proxied")
+	upstreamAllow           = flag.String("upstream-allow", "", "Comma-separated metadata path patterns which may be reverse proxied; default is all")
+	upstreamDeny            = flag.String("upstream-deny", "", "Comma-separated metadata path patterns which may not be reverse proxied")
+	requireToken            = flag.Bool("require-imdsv2", false, "Whether metadata requests must present an IMDSv2 session token")
+	ecsCredentials          = flag.Bool("ecs-credentials", false, "Whether the ECS container credentials endpoint should be served")
+	ecsCredentialsKeyFile   = flag.String("ecs-credentials-key-file", "", "Path of the base64 encoded 256 bit key from which ECS credentials IDs are derived; default is a random key")
+	identifyHostNetwork     = flag.Bool("identify-host-network", false, "Whether containers using the host's network should be identified by their sockets")
+	procfsRoot              = flag.String("procfs-root", "/proc", "Path of the host's procfs, used to identify containers using the host's network")
+	emulateMetaData         = flag.Bool("emulate-meta-data", false, "Whether the EC2 MetaData API should be emulated instead of reverse proxied")
+	emulatedMetaData        = flag.String("emulated-meta-data-config", "", "Path of a JSON file describing the emulated instance")
 	verbose                 = flag.Bool("verbose", false, "Enable verbose logging")
 )
 
@@ -44,26 +111,413 @@ func main() {
 		os.Exit(1)
 	}
 
+	if (*defaultAccount != "") && !accountIDPattern.MatchString(*defaultAccount) {
+		log.WithField("account", *defaultAccount).Error("Invalid default account, expected a 12 digit account ID")
+		os.Exit(1)
+	} else if !partitions[*defaultPartition] {
+		log.WithField("partition", *defaultPartition).Error("Invalid default partition, expected aws, aws-cn or aws-us-gov")
+		os.Exit(1)
+	}
+
+	roleConfig := &iamDocker.Config{
+		DefaultAccount:   *defaultAccount,
+		DefaultPartition: *defaultPartition,
+	}
+	externalIDsByARN, err := resolveRoleKeys(externalIDs.pairs, roleConfig)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Invalid external IDs")
+		os.Exit(1)
+	}
+	chains, err := resolveRoleChains(*roleChains, roleConfig)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Invalid role chains")
+		os.Exit(1)
+	}
+
+	tagLabels := make(map[string]string)
+	for _, entry := range splitList(*sessionTagLabels) {
+		idx := strings.Index(entry, "=")
+		if idx < 0 {
+			tagLabels[entry] = entry
+		} else {
+			tagLabels[entry[:idx]] = entry[idx+1:]
+		}
+	}
+
+	sessionNameTmpl, err := parseTemplate("session-name", *sessionNameTemplate)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Invalid session name template")
+		os.Exit(1)
+	}
+	sourceIdentityTmpl, err := parseTemplate("source-identity", *sourceIdentityTemplate)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Invalid source identity template")
+		os.Exit(1)
+	}
+
 	config := &app.Config{
 		ListenAddr:              *listenAddr,
+		DiagnosticsAddr:         *diagnosticsAddr,
 		MetaDataUpstream:        metaDataUpstream,
 		EventHandlers:           *eventHandlers,
 		ReadTimeout:             *readTimeout,
 		WriteTimeout:            *writeTimeout,
 		DockerSyncPeriod:        *dockerSyncPeriod,
 		CredentialRefreshPeriod: *credentialRefreshPeriod,
+		CredentialIdleTimeout:   *credentialIdleTimeout,
+		RefreshWorkers:          *refreshWorkers,
+		DefaultAccount:          *defaultAccount,
+		DefaultPartition:        *defaultPartition,
+		SessionDuration:         *sessionDuration,
+		ExternalIDs:             externalIDsByARN,
+		RoleChains:              chains,
+		TagLabels:               tagLabels,
+		TransitiveTagKeys:       splitList(*transitiveTagKeys),
+		SessionPolicyDir:        *sessionPolicyDir,
+		SessionNameTemplate:     sessionNameTmpl,
+		SourceIdentityTemplate:  sourceIdentityTmpl,
 		DisableUpstream:         *disableUpstream,
+		UpstreamAllow:           splitList(*upstreamAllow),
+		UpstreamDeny:            splitList(*upstreamDeny),
+		RequireToken:            *requireToken,
+		ECSCredentials:          *ecsCredentials,
+		IdentifyHostNetwork:     *identifyHostNetwork,
+		ProcfsRoot:              *procfsRoot,
+	}
+	config.CredentialSource, err = newCredentialSource(*credentialSource)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"source": *credentialSource,
+			"error":  err.Error(),
+		}).Error("Unable to create credential source")
+		os.Exit(1)
+	}
+	if *credentialCache != "" {
+		config.CredentialCache, err = newCredentialCache(*credentialCache, *credentialCacheKeyFile)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"path":  *credentialCache,
+				"error": err.Error(),
+			}).Error("Unable to create credential cache")
+			os.Exit(1)
+		}
+	}
+	if *ecsCredentials {
+		config.ECSCredentialsKey, err = newCredentialsIDKey(*ecsCredentialsKeyFile)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"path":  *ecsCredentialsKeyFile,
+				"error": err.Error(),
+			}).Error("Unable to load ECS credentials key")
+			os.Exit(1)
+		}
+	}
+	if *emulateMetaData {
+		config.EmulatedMetaData, err = iamMetadata.LoadConfig(*emulatedMetaData)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"path":  *emulatedMetaData,
+				"error": err.Error(),
+			}).Error("Unable to load emulated MetaData config")
+			os.Exit(1)
+		}
 	}
 	dockerClient, err := docker.NewClientFromEnv()
 	if err != nil {
 		log.WithField("error", err.Error()).Error("Unable to create Docker client from environment, please set DOCKER_HOST")
 		os.Exit(1)
 	}
-	stsClient := sts.New(session.New())
+	awsSession, err := newAWSSession()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Unable to create AWS session")
+		os.Exit(1)
+	}
+	stsClient := sts.New(awsSession)
+	if config.CredentialSource == nil {
+		err = reportCallerIdentity(stsClient, log)
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Unable to identify the base identity, check its credentials and the STS endpoint")
+			os.Exit(1)
+		}
+	}
+	chainedSTSClient := func(creds *sts.Credentials) iam.STSClient {
+		return sts.New(awsSession, &aws.Config{
+			Credentials: credentials.NewStaticCredentials(*creds.AccessKeyId, *creds.SecretAccessKey, *creds.SessionToken),
+		})
+	}
 
-	inst := app.New(config, dockerClient, stsClient)
+	inst := app.New(config, dockerClient, stsClient, chainedSTSClient)
 	err = inst.Run()
+	if err == nil {
+		log.Info("Exiting")
+		os.Exit(0)
+	}
 	log.WithField("error", err.Error()).Error("Fatal error, exiting")
 
 	os.Exit(1)
 }
+
+// splitList splits a comma-separated flag value, ignoring empty entries.
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// splitPairs splits a comma-separated flag value of `<key>=<value>` pairs.
+func splitPairs(value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, entry := range splitList(value) {
+		idx := strings.Index(entry, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("Expected <key>=<value>, got: %s", entry)
+		}
+		pairs[entry[:idx]] = entry[idx+1:]
+	}
+	return pairs, nil
+}
+
+// resolveRoleKeys resolves the role of each key of the pairs, the same way as
+// the roles of containers.
+func resolveRoleKeys(pairs map[string]string, config *iamDocker.Config) (map[string]string, error) {
+	resolved := make(map[string]string, len(pairs))
+	for role, value := range pairs {
+		arn, err := iamDocker.ResolveRoleARN(role, config)
+		if err != nil {
+			return nil, err
+		}
+		resolved[arn] = value
+	}
+	return resolved, nil
+}
+
+// resolveRoleChains parses the chains of the role chains flag, resolving the
+// role and each intermediate role the same way as the roles of containers.
+func resolveRoleChains(value string, config *iamDocker.Config) (map[string][]string, error) {
+	chainsByRole, err := splitPairs(value)
+	if err != nil {
+		return nil, err
+	}
+	chainsByRole, err = resolveRoleKeys(chainsByRole, config)
+	if err != nil {
+		return nil, err
+	}
+	chains := make(map[string][]string, len(chainsByRole))
+	for arn, chain := range chainsByRole {
+		for _, hop := range strings.Split(chain, "|") {
+			hop, err = iamDocker.ResolveRoleARN(hop, config)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid chain of %s: %s", arn, err.Error())
+			}
+			chains[arn] = append(chains[arn], hop)
+		}
+	}
+	return chains, nil
+}
+
+// pairsFlag defines a repeatable flag of `<key>=<value>` pairs. Each pair is
+// split on its first `=`, so values may contain `=` and `,`.
+func pairsFlag(name string, usage string) *pairsValue {
+	value := &pairsValue{pairs: make(map[string]string)}
+	flag.Var(value, name, usage)
+	return value
+}
+
+func (value *pairsValue) String() string {
+	if value == nil {
+		return ""
+	}
+	entries := make([]string, 0, len(value.pairs))
+	for key, val := range value.pairs {
+		entries = append(entries, key+"="+val)
+	}
+	return strings.Join(entries, " ")
+}
+
+func (value *pairsValue) Set(entry string) error {
+	idx := strings.Index(entry, "=")
+	if idx <= 0 {
+		return fmt.Errorf("Expected <key>=<value>, got: %s", entry)
+	}
+	value.pairs[strings.TrimSpace(entry[:idx])] = entry[idx+1:]
+	return nil
+}
+
+type pairsValue struct {
+	pairs map[string]string
+}
+
+// newAWSSession creates the session of the base identity which assumes roles,
+// with the configured STS endpoint. When a web identity role is configured, the
+// base identity is that role, assumed with the token.
+func newAWSSession() (*session.Session, error) {
+	options := session.Options{
+		Profile:           *awsProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if *awsCredentialsFile != "" {
+		// The credentials file replaces the default one, but profiles are still
+		// read from the shared config file.
+		configFile := os.Getenv("AWS_CONFIG_FILE")
+		if configFile == "" {
+			configFile = defaults.SharedConfigFilename()
+		}
+		options.SharedConfigFiles = []string{configFile, *awsCredentialsFile}
+	}
+	if *stsRegion != "" {
+		options.Config.Region = aws.String(*stsRegion)
+	}
+	if *stsEndpoint != "" {
+		endpoint, err := url.Parse(*stsEndpoint)
+		if (err != nil) || (endpoint.Scheme == "") || (endpoint.Host == "") {
+			return nil, fmt.Errorf("Invalid STS endpoint: %s", *stsEndpoint)
+		}
+		options.Config.Endpoint = aws.String(*stsEndpoint)
+	}
+	switch *stsEndpointType {
+	case "":
+	case "global":
+		options.Config.STSRegionalEndpoint = endpoints.LegacySTSEndpoint
+	case "regional":
+		options.Config.STSRegionalEndpoint = endpoints.RegionalSTSEndpoint
+	default:
+		return nil, fmt.Errorf("STS endpoint type must be global or regional, not: %s", *stsEndpointType)
+	}
+
+	awsSession, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(awsSession.Config.Region) == "" {
+		// The global endpoint is in us-east-1, which is used when no region is
+		// configured at all.
+		awsSession.Config.Region = aws.String(endpoints.UsEast1RegionID)
+	}
+
+	if (*webIdentityRoleARN == "") != (*webIdentityTokenFile == "") {
+		return nil, fmt.Errorf("Both --web-identity-role-arn and --web-identity-token-file must be set")
+	} else if *webIdentityRoleARN != "" {
+		// AssumeRoleWithWebIdentity is authenticated by the token, so its
+		// requests aren't signed.
+		anonymousClient := sts.New(awsSession, &aws.Config{Credentials: credentials.AnonymousCredentials})
+		provider := iam.NewWebIdentityProvider(anonymousClient, *webIdentityRoleARN, *webIdentityTokenFile, *webIdentitySessionName)
+		awsSession = awsSession.Copy(&aws.Config{Credentials: credentials.NewCredentials(provider)})
+	}
+	return awsSession, nil
+}
+
+// reportCallerIdentity logs the identity which assumes roles, failing when its
+// credentials or the STS endpoint are misconfigured.
+func reportCallerIdentity(client *sts.STS, log *logrus.Entry) error {
+	output, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"account":  aws.StringValue(output.Account),
+		"arn":      aws.StringValue(output.Arn),
+		"region":   aws.StringValue(client.Config.Region),
+		"endpoint": client.Endpoint,
+	}).Info("Assuming roles as the base identity")
+	return nil
+}
+
+// newCredentialSource creates the named credential source. STS is the default
+// source, for which nil is returned.
+func newCredentialSource(name string) (iam.CredentialSource, error) {
+	switch name {
+	case "sts":
+		return nil, nil
+	case "file":
+		if *credentialFile == "" {
+			return nil, fmt.Errorf("--credential-file must be set")
+		}
+		return iam.NewFileSource(*credentialFile), nil
+	case "vault":
+		roles, err := splitPairs(*vaultRoles)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		if *vaultCACert != "" {
+			pem, err := ioutil.ReadFile(*vaultCACert)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in: %s", *vaultCACert)
+			}
+			client.Transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			}
+		}
+		return iam.NewVaultSource(&iam.VaultConfig{
+			Address:   *vaultAddr,
+			Token:     os.Getenv("VAULT_TOKEN"),
+			TokenFile: *vaultTokenFile,
+			Namespace: *vaultNamespace,
+			Mount:     *vaultMount,
+			Roles:     roles,
+			Client:    client,
+		})
+	}
+	return nil, fmt.Errorf("Unknown credential source: %s", name)
+}
+
+// newCredentialCache creates the encrypted credential cache, with the key read
+// from the key file, or from the environment when there is no key file.
+func newCredentialCache(path string, keyFile string) (iam.CredentialCache, error) {
+	encoded := os.Getenv(cacheKeyEnv)
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	} else if encoded == "" {
+		return nil, fmt.Errorf("Either --credential-cache-key-file or $%s must be set", cacheKeyEnv)
+	}
+	key, err := iam.DecodeCacheKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return iam.NewEncryptedFileCache(path, key)
+}
+
+// newCredentialsIDKey reads the key from which ECS credentials IDs are derived.
+// When there is no key file, the key is random, and the IDs change whenever
+// the agent restarts.
+func newCredentialsIDKey(keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		key := make([]byte, credentialsIDKeyBytes)
+		_, err := rand.Read(key)
+		return key, err
+	}
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	} else if len(key) != credentialsIDKeyBytes {
+		return nil, fmt.Errorf("Key must be %d bytes, not %d", credentialsIDKeyBytes, len(key))
+	}
+	return key, nil
+}
+
+// parseTemplate parses a template flag value. When the value is empty, there is
+// no template.
+func parseTemplate(name string, value string) (*template.Template, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return template.New(name).Parse(value)
+}
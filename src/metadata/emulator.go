@@ -0,0 +1,217 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	latestVersion   = "latest"
+	documentVersion = "2017-09-30"
+	architecture    = "x86_64"
+)
+
+var (
+	datedVersion = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+)
+
+// LoadConfig reads the emulated instance's config from a JSON file and fills in
+// defaults for anything which isn't set. When the path is empty, only defaults
+// are used.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(content, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AccountID == "" {
+		config.AccountID = "000000000000"
+	}
+	if (config.Region == "") && (config.AvailabilityZone != "") {
+		config.Region = config.AvailabilityZone[:len(config.AvailabilityZone)-1]
+	} else if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.AvailabilityZone == "" {
+		config.AvailabilityZone = config.Region + "a"
+	}
+	if config.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		config.Hostname = hostname
+	}
+	if config.ImageID == "" {
+		config.ImageID = "ami-00000000000000000"
+	}
+	if config.InstanceID == "" {
+		config.InstanceID = "i-00000000000000000"
+	}
+	if config.InstanceType == "" {
+		config.InstanceType = "t2.micro"
+	}
+	if config.LocalIPv4 == "" {
+		config.LocalIPv4 = "127.0.0.1"
+	}
+	if config.MAC == "" {
+		config.MAC = "02:00:00:00:00:00"
+	}
+
+	return config, nil
+}
+
+// NewEmulator creates a http.Handler which serves the metadata tree of the
+// configured instance, in place of the EC2 metadata API. IAM credentials are
+// not part of the tree.
+func NewEmulator(config *Config) (http.Handler, error) {
+	values, err := valuesForConfig(config, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &emulator{values: values}, nil
+}
+
+func (emulator *emulator) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	logger := log.WithField("path", request.URL.Path)
+	if (request.Method != "GET") && (request.Method != "HEAD") {
+		logger.WithField("method", request.Method).Info("Denying request with invalid method")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(request.URL.Path, "/")
+	if path == "" {
+		emulator.serveText(writer, latestVersion)
+		return
+	}
+
+	idx := strings.Index(path, "/")
+	if idx < 0 {
+		idx = len(path)
+	}
+	version := path[:idx]
+	if (version != latestVersion) && !datedVersion.MatchString(version) {
+		logger.Debug("Unknown API version")
+		serveNotFound(writer)
+		return
+	}
+	relative := strings.TrimPrefix(path[idx:], "/")
+
+	if value, hasKey := emulator.values[relative]; hasKey {
+		emulator.serveText(writer, value)
+		return
+	}
+	children := emulator.children(strings.TrimSuffix(relative, "/"))
+	if len(children) > 0 {
+		emulator.serveText(writer, strings.Join(children, "\n"))
+		return
+	}
+
+	logger.Debug("Unknown path")
+	serveNotFound(writer)
+}
+
+// children lists the entries of the directory, where subdirectories have a
+// trailing slash.
+func (emulator *emulator) children(dir string) []string {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	set := make(map[string]bool)
+	for path := range emulator.values {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		rest := path[len(prefix):]
+		idx := strings.Index(rest, "/")
+		if idx >= 0 {
+			set[rest[:idx+1]] = true
+		} else if rest != "" {
+			set[rest] = true
+		}
+	}
+	children := make([]string, 0, len(set))
+	for child := range set {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (emulator *emulator) serveText(writer http.ResponseWriter, value string) {
+	writer.Header().Set("Content-Type", "text/plain")
+	_, _ = writer.Write([]byte(value))
+}
+
+func serveNotFound(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "text/html")
+	writer.WriteHeader(http.StatusNotFound)
+	_, _ = writer.Write([]byte(NotFoundBody))
+}
+
+// valuesForConfig builds the metadata tree, keyed by the path below the API
+// version.
+func valuesForConfig(config *Config, pendingTime time.Time) (map[string]string, error) {
+	document, err := json.MarshalIndent(&InstanceIdentityDocument{
+		AccountID:        config.AccountID,
+		Architecture:     architecture,
+		AvailabilityZone: config.AvailabilityZone,
+		ImageID:          config.ImageID,
+		InstanceID:       config.InstanceID,
+		InstanceType:     config.InstanceType,
+		PendingTime:      pendingTime.UTC().Truncate(time.Second),
+		PrivateIP:        config.LocalIPv4,
+		Region:           config.Region,
+		Version:          documentVersion,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{
+		"dynamic/instance-identity/document": string(document),
+		"meta-data/ami-id":                   config.ImageID,
+		"meta-data/ami-launch-index":         "0",
+		"meta-data/hostname":                 config.Hostname,
+		"meta-data/instance-id":              config.InstanceID,
+		"meta-data/instance-life-cycle":      "on-demand",
+		"meta-data/instance-type":            config.InstanceType,
+		"meta-data/local-hostname":           config.Hostname,
+		"meta-data/local-ipv4":               config.LocalIPv4,
+		"meta-data/mac":                      config.MAC,
+		"meta-data/network/interfaces/macs/" + config.MAC + "/device-number": "0",
+		"meta-data/network/interfaces/macs/" + config.MAC + "/local-ipv4s":   config.LocalIPv4,
+		"meta-data/network/interfaces/macs/" + config.MAC + "/owner-id":      config.AccountID,
+		"meta-data/placement/availability-zone":                              config.AvailabilityZone,
+		"meta-data/placement/region":                                         config.Region,
+		"meta-data/services/domain":                                          "amazonaws.com",
+		"meta-data/services/partition":                                       "aws",
+	}
+	if config.UserData != "" {
+		values["user-data"] = config.UserData
+	}
+	for path, value := range config.Values {
+		values[strings.Trim(path, "/")] = value
+	}
+
+	return values, nil
+}
+
+type emulator struct {
+	values map[string]string
+}
@@ -0,0 +1,168 @@
+package metadata_test
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/swipely/iam-docker/src/metadata"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Emulator", func() {
+	var (
+		config  *Config
+		subject http.Handler
+	)
+
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		subject.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	BeforeEach(func() {
+		var err error
+		config, err = LoadConfig("")
+		Expect(err).To(BeNil())
+		config.InstanceID = "i-0123456789abcdef0"
+		config.Values = map[string]string{
+			"meta-data/tags/instance/Name": "laptop",
+			"/meta-data/instance-type":     "m5.large",
+		}
+		subject, err = NewEmulator(config)
+		Expect(err).To(BeNil())
+	})
+
+	Describe("LoadConfig", func() {
+		var (
+			dir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "metadata")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		Context("When no path is given", func() {
+			It("Uses defaults", func() {
+				config, err := LoadConfig("")
+				Expect(err).To(BeNil())
+				Expect(config.Region).To(Equal("us-east-1"))
+				Expect(config.AvailabilityZone).To(Equal("us-east-1a"))
+				Expect(config.Hostname).ToNot(BeEmpty())
+			})
+		})
+
+		Context("When only the availability zone is set", func() {
+			It("Derives the region", func() {
+				path := filepath.Join(dir, "config.json")
+				content := `{"availabilityZone": "eu-west-1c", "instanceId": "i-1"}`
+				Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(BeNil())
+				config, err := LoadConfig(path)
+				Expect(err).To(BeNil())
+				Expect(config.Region).To(Equal("eu-west-1"))
+				Expect(config.AvailabilityZone).To(Equal("eu-west-1c"))
+				Expect(config.InstanceID).To(Equal("i-1"))
+			})
+		})
+
+		Context("When the file is invalid", func() {
+			It("Returns an error", func() {
+				path := filepath.Join(dir, "config.json")
+				Expect(ioutil.WriteFile(path, []byte("{"), 0600)).To(BeNil())
+				_, err := LoadConfig(path)
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		Context("When the file does not exist", func() {
+			It("Returns an error", func() {
+				_, err := LoadConfig(filepath.Join(dir, "missing.json"))
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+
+	Context("Requesting a leaf", func() {
+		It("Serves the configured value", func() {
+			response := request("GET", "/latest/meta-data/instance-id")
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(Equal("i-0123456789abcdef0"))
+		})
+
+		It("Serves dated API versions", func() {
+			response := request("GET", "/2016-09-02/meta-data/placement/region")
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(Equal("us-east-1"))
+		})
+
+		It("Prefers explicit values", func() {
+			response := request("GET", "/latest/meta-data/instance-type")
+			Expect(response.Body.String()).To(Equal("m5.large"))
+		})
+
+		It("Does not serve a leaf with a trailing slash", func() {
+			response := request("GET", "/latest/meta-data/instance-id/")
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+			Expect(response.Body.String()).To(Equal(NotFoundBody))
+		})
+	})
+
+	Context("Requesting a directory", func() {
+		It("Lists the versions at the root", func() {
+			response := request("GET", "/")
+			Expect(response.Body.String()).To(Equal("latest"))
+		})
+
+		It("Lists its entries with or without a trailing slash", func() {
+			for _, path := range []string{"/latest/meta-data/placement", "/latest/meta-data/placement/"} {
+				response := request("GET", path)
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Body.String()).To(Equal("availability-zone\nregion"))
+			}
+		})
+
+		It("Marks subdirectories", func() {
+			response := request("GET", "/latest/meta-data/tags/")
+			Expect(response.Body.String()).To(Equal("instance/"))
+		})
+	})
+
+	Context("Requesting the instance identity document", func() {
+		It("Describes the instance", func() {
+			response := request("GET", "/latest/dynamic/instance-identity/document")
+			Expect(response.Code).To(Equal(http.StatusOK))
+			document := &InstanceIdentityDocument{}
+			Expect(json.Unmarshal(response.Body.Bytes(), document)).To(BeNil())
+			Expect(document.InstanceID).To(Equal("i-0123456789abcdef0"))
+			Expect(document.Region).To(Equal("us-east-1"))
+			Expect(document.AccountID).To(Equal(config.AccountID))
+			Expect(document.PendingTime.IsZero()).To(BeFalse())
+		})
+	})
+
+	Context("Requesting an unknown path", func() {
+		It("Responds with a 404", func() {
+			for _, path := range []string{"/latest/meta-data/missing", "/latest/user-data", "/other/meta-data/instance-id"} {
+				response := request("GET", path)
+				Expect(response.Code).To(Equal(http.StatusNotFound))
+			}
+		})
+	})
+
+	Context("Requesting with another method", func() {
+		It("Responds with a 405", func() {
+			response := request("POST", "/latest/meta-data/instance-id")
+			Expect(response.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
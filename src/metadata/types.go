@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"github.com/Sirupsen/logrus"
+	"time"
+)
+
+// NotFoundBody is the page served by the EC2 metadata API when a path does
+// not exist.
+const NotFoundBody = `<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+	"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>404 - Not Found</title>
+ </head>
+ <body>
+  <h1>404 - Not Found</h1>
+ </body>
+</html>
+`
+
+var (
+	log = logrus.WithField("prefix", "metadata")
+)
+
+// Config describes the instance which is emulated. Empty fields are given
+// defaults by LoadConfig.
+type Config struct {
+	AccountID        string
+	AvailabilityZone string
+	Hostname         string
+	ImageID          string
+	InstanceID       string
+	InstanceType     string
+	LocalIPv4        string
+	MAC              string
+	Region           string
+	UserData         string
+	// Values sets arbitrary paths below the API version, such as
+	// `meta-data/tags/instance/Name`. They take precedence over the fields
+	// above.
+	Values map[string]string
+}
+
+// InstanceIdentityDocument is served at
+// `dynamic/instance-identity/document`.
+type InstanceIdentityDocument struct {
+	AccountID               string    `json:"accountId"`
+	Architecture            string    `json:"architecture"`
+	AvailabilityZone        string    `json:"availabilityZone"`
+	BillingProducts         []string  `json:"billingProducts"`
+	DevpayProductCodes      []string  `json:"devpayProductCodes"`
+	MarketplaceProductCodes []string  `json:"marketplaceProductCodes"`
+	ImageID                 string    `json:"imageId"`
+	InstanceID              string    `json:"instanceId"`
+	InstanceType            string    `json:"instanceType"`
+	KernelID                *string   `json:"kernelId"`
+	PendingTime             time.Time `json:"pendingTime"`
+	PrivateIP               string    `json:"privateIp"`
+	RamdiskID               *string   `json:"ramdiskId"`
+	Region                  string    `json:"region"`
+	Version                 string    `json:"version"`
+}
@@ -0,0 +1,30 @@
+package mock
+
+import (
+	"fmt"
+	"net"
+)
+
+// ContainerResolver implements
+// github.com/swipely/iam-docker/src/proc.ContainerResolver. To fake a socket
+// owned by a container, add its client address to ContainerIDsByClient.
+type ContainerResolver struct {
+	ContainerIDsByClient map[string]string
+}
+
+// NewContainerResolver creates a new mock ContainerResolver.
+func NewContainerResolver() *ContainerResolver {
+	return &ContainerResolver{
+		ContainerIDsByClient: make(map[string]string),
+	}
+}
+
+// ContainerIDForConnection looks up the client address in the mock's
+// ContainerIDsByClient.
+func (mock *ContainerResolver) ContainerIDForConnection(client *net.TCPAddr) (string, error) {
+	id, hasKey := mock.ContainerIDsByClient[client.String()]
+	if !hasKey {
+		return "", fmt.Errorf("Unable to find socket for: %s", client.String())
+	}
+	return id, nil
+}
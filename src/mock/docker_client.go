@@ -26,14 +26,15 @@ func (mock *DockerClient) AddEventListener(channel chan<- *docker.APIEvents) err
 	return nil
 }
 
-// AddContainer adds the container the to the store and fires off the event
-// listeners.
+// AddContainer adds the container the to the store, marks it as running, and
+// fires off the event listeners.
 func (mock *DockerClient) AddContainer(container *docker.Container) error {
 	_, hasKey := mock.containersByID[container.ID]
 	if hasKey {
 		return &docker.ContainerAlreadyRunning{ID: container.ID}
 	}
 
+	container.State.Running = true
 	mock.containersByID[container.ID] = container
 	mock.triggerListeners(&docker.APIEvents{
 		ID:     container.ID,
@@ -59,6 +60,19 @@ func (mock *DockerClient) RemoveContainer(id string) error {
 	return nil
 }
 
+// StopContainer marks the container as no longer running, without firing off
+// the event listeners, as if its event had not been handled yet.
+func (mock *DockerClient) StopContainer(id string) error {
+	container, hasKey := mock.containersByID[id]
+	if !hasKey {
+		return &docker.NoSuchContainer{ID: id}
+	}
+
+	container.State.Running = false
+
+	return nil
+}
+
 // InspectContainer looks up a container by its ID.
 func (mock *DockerClient) InspectContainer(id string) (*docker.Container, error) {
 	container, hasKey := mock.containersByID[id]
@@ -3,18 +3,40 @@ package mock
 import (
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/swipely/iam-docker/src/iam"
+	"sync"
 )
 
 // STSClient implements github.com/swipely/iam-docker/src/iam.STSClient.
 type STSClient struct {
 	AssumableRoles map[string]*sts.Credentials
+	// Errors are returned when assuming the role, by ARN.
+	Errors map[string]error
+	// MaxDurations rejects longer sessions of the role, in seconds.
+	MaxDurations map[string]int64
+	// Inputs records each request to assume a role.
+	Inputs []*sts.AssumeRoleInput
+	// WebIdentityInputs records each request to assume a role with a web
+	// identity token.
+	WebIdentityInputs []*sts.AssumeRoleWithWebIdentityInput
+	// Callers records the access key ID which signed each request in Inputs,
+	// which is empty for requests made by the base client.
+	Callers []string
+	// Gate blocks requests until it's closed, when set.
+	Gate   chan struct{}
+	mutex  sync.Mutex
+	parent *STSClient
+	caller string
 }
 
 // NewSTSClient returns a mock STSClient.
 func NewSTSClient() *STSClient {
 	return &STSClient{
 		AssumableRoles: make(map[string]*sts.Credentials),
+		Errors:         make(map[string]error),
+		MaxDurations:   make(map[string]int64),
 	}
 }
 
@@ -25,10 +47,83 @@ func (mock *STSClient) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOu
 	} else if input.RoleArn == nil {
 		return nil, errors.New("No RoleArn given")
 	}
-	credential, hasKey := mock.AssumableRoles[*input.RoleArn]
+	root := mock
+	if mock.parent != nil {
+		root = mock.parent
+	}
+	if root.Gate != nil {
+		<-root.Gate
+	}
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	root.Inputs = append(root.Inputs, input)
+	root.Callers = append(root.Callers, mock.caller)
+	if err, hasKey := root.Errors[*input.RoleArn]; hasKey {
+		return nil, err
+	}
+	max, hasMax := root.MaxDurations[*input.RoleArn]
+	if hasMax && (input.DurationSeconds != nil) && (*input.DurationSeconds > max) {
+		return nil, awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.", nil)
+	}
+	credential, hasKey := root.AssumableRoles[*input.RoleArn]
 	if !hasKey {
 		return nil, fmt.Errorf("Cannot assume role: %s", *input.RoleArn)
 	}
 	output := &sts.AssumeRoleOutput{Credentials: credential}
 	return output, nil
 }
+
+// AssumeRoleWithWebIdentity uses the mock's AssumableRoles to try to assume a
+// new IAM role with a web identity token.
+func (mock *STSClient) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	if input == nil {
+		return nil, errors.New("No AssumeRoleWithWebIdentityInput given")
+	} else if input.RoleArn == nil {
+		return nil, errors.New("No RoleArn given")
+	} else if input.WebIdentityToken == nil {
+		return nil, errors.New("No WebIdentityToken given")
+	}
+	root := mock
+	if mock.parent != nil {
+		root = mock.parent
+	}
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	root.WebIdentityInputs = append(root.WebIdentityInputs, input)
+	if err, hasKey := root.Errors[*input.RoleArn]; hasKey {
+		return nil, err
+	}
+	credential, hasKey := root.AssumableRoles[*input.RoleArn]
+	if !hasKey {
+		return nil, fmt.Errorf("Cannot assume role: %s", *input.RoleArn)
+	}
+	return &sts.AssumeRoleWithWebIdentityOutput{Credentials: credential}, nil
+}
+
+// ClientForCredentials implements
+// github.com/swipely/iam-docker/src/iam.STSClientFactory. The requests of the
+// returned client are recorded by this mock.
+func (mock *STSClient) ClientForCredentials(creds *sts.Credentials) iam.STSClient {
+	caller := ""
+	if creds.AccessKeyId != nil {
+		caller = *creds.AccessKeyId
+	}
+	return &STSClient{parent: mock, caller: caller}
+}
+
+// LastInput returns the most recent request to assume a role.
+func (mock *STSClient) LastInput() *sts.AssumeRoleInput {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	if len(mock.Inputs) == 0 {
+		return nil
+	}
+	return mock.Inputs[len(mock.Inputs)-1]
+}
+
+// InputCount returns the number of requests to assume a role.
+func (mock *STSClient) InputCount() int {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	return len(mock.Inputs)
+}
@@ -0,0 +1,262 @@
+package proc
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	listenState = "0A"
+	// minScanInterval bounds how often the file descriptors of every process
+	// are scanned, since any container can cause a scan with a request.
+	minScanInterval = time.Second
+)
+
+var (
+	socketTables       = []string{"net/tcp", "net/tcp6"}
+	containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+	pidPattern         = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// NewContainerResolver creates a ContainerResolver which reads the procfs
+// mounted at root. To see the host's processes, iam-docker must share the
+// host's PID namespace or have the host's procfs mounted.
+func NewContainerResolver(root string) ContainerResolver {
+	return &containerResolver{
+		root:        root,
+		fdsBySocket: make(map[string]string),
+	}
+}
+
+func (resolver *containerResolver) ContainerIDForConnection(client *net.TCPAddr) (string, error) {
+	logger := log.WithField("client", client.String())
+	logger.Debug("Looking up socket owner")
+
+	inode, err := resolver.socketInode(client)
+	if err != nil {
+		return "", err
+	}
+	pid, err := resolver.pidForInode(inode)
+	if err != nil {
+		return "", err
+	}
+	id, err := resolver.containerIDForPID(pid)
+	if err != nil {
+		return "", err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"inode": inode,
+		"pid":   pid,
+		"id":    id,
+	}).Debug("Found socket owner")
+
+	return id, nil
+}
+
+// socketInode finds the inode of the socket whose local address is the
+// client's address. The client's view of the remote address can't be used,
+// since it's the original destination before the connection was redirected.
+func (resolver *containerResolver) socketInode(client *net.TCPAddr) (string, error) {
+	for _, table := range socketTables {
+		file, err := os.Open(filepath.Join(resolver.root, table))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Scan()
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if (len(fields) < 10) || (fields[3] == listenState) || (fields[9] == "0") {
+				continue
+			}
+			ip, port, err := parseSocketAddress(fields[1])
+			if err != nil {
+				continue
+			}
+			if (port == client.Port) && ip.Equal(client.IP) {
+				file.Close()
+				return fields[9], nil
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("Unable to find socket for: %s", client.String())
+}
+
+// pidForInode finds the process which has a file descriptor open for the
+// socket with the given inode. Each scan indexes the file descriptors of every
+// socket, which are checked again before they're used, since inodes may be
+// reused. Sockets which aren't indexed cause another scan, but no more than
+// one per minScanInterval; requests made in the meantime wait for it.
+func (resolver *containerResolver) pidForInode(inode string) (string, error) {
+	requested := time.Now()
+	target := socketLink(inode)
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+
+	if pid, found := resolver.indexedPID(inode); found {
+		return pid, nil
+	} else if resolver.scannedAt.After(requested) {
+		// The socket was missing from a scan which started after this request.
+		return "", fmt.Errorf("Unable to find process for socket inode: %s", inode)
+	}
+
+	wait := minScanInterval - time.Since(resolver.scannedAt)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	err := resolver.scan()
+	if err != nil {
+		return "", err
+	}
+
+	if pid, found := resolver.indexedPID(inode); found {
+		return pid, nil
+	}
+	log.WithField("socket", target).Debug("Socket owner not found")
+	return "", fmt.Errorf("Unable to find process for socket inode: %s", inode)
+}
+
+// indexedPID returns the process of the socket's indexed file descriptor, when
+// it's still open for the socket. The caller must hold the lock.
+func (resolver *containerResolver) indexedPID(inode string) (string, bool) {
+	fdPath, hasKey := resolver.fdsBySocket[inode]
+	if !hasKey {
+		return "", false
+	}
+	link, err := os.Readlink(filepath.Join(resolver.root, fdPath))
+	if (err != nil) || (link != socketLink(inode)) {
+		delete(resolver.fdsBySocket, inode)
+		return "", false
+	}
+	return strings.SplitN(fdPath, string(filepath.Separator), 2)[0], true
+}
+
+// scan indexes the file descriptor of each socket which is open in any process.
+// The caller must hold the lock.
+func (resolver *containerResolver) scan() error {
+	resolver.scannedAt = time.Now()
+	pids, err := readDirNames(resolver.root)
+	if err != nil {
+		return err
+	}
+
+	fdsBySocket := make(map[string]string, len(resolver.fdsBySocket))
+	for _, pid := range pids {
+		if !pidPattern.MatchString(pid) {
+			continue
+		}
+		fdDir := filepath.Join(pid, "fd")
+		// Processes may exit or be inaccessible while they're being scanned.
+		fds, err := readDirNames(filepath.Join(resolver.root, fdDir))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			fdPath := filepath.Join(fdDir, fd)
+			link, err := os.Readlink(filepath.Join(resolver.root, fdPath))
+			if (err != nil) || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			if _, hasKey := fdsBySocket[inode]; !hasKey {
+				fdsBySocket[inode] = fdPath
+			}
+		}
+	}
+	resolver.fdsBySocket = fdsBySocket
+	log.WithField("sockets", len(fdsBySocket)).Debug("Indexed socket owners")
+
+	return nil
+}
+
+// containerIDForPID finds the Docker container ID in the process's cgroup
+// paths, such as `/docker/<id>` or `/system.slice/docker-<id>.scope`.
+func (resolver *containerResolver) containerIDForPID(pid string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(resolver.root, pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		ids := containerIDPattern.FindAllString(parts[2], -1)
+		if len(ids) > 0 {
+			return ids[len(ids)-1], nil
+		}
+	}
+
+	return "", fmt.Errorf("Process is not in a container: %s", pid)
+}
+
+// parseSocketAddress parses an address from a procfs socket table, such as
+// `0100007F:1F90`. The IP is stored as 32-bit words in host byte order, which
+// is assumed to be little-endian, and the port is big-endian.
+func parseSocketAddress(value string) (net.IP, int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("Invalid socket address: %s", value)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return nil, 0, err
+	} else if (len(raw) != net.IPv4len) && (len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("Invalid socket address: %s", value)
+	}
+	ip := make(net.IP, len(raw))
+	for idx := 0; idx < len(raw); idx += 4 {
+		ip[idx] = raw[idx+3]
+		ip[idx+1] = raw[idx+2]
+		ip[idx+2] = raw[idx+1]
+		ip[idx+3] = raw[idx]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, int(port), nil
+}
+
+func socketLink(inode string) string {
+	return "socket:[" + inode + "]"
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+type containerResolver struct {
+	mutex       sync.Mutex
+	root        string
+	fdsBySocket map[string]string
+	scannedAt   time.Time
+}
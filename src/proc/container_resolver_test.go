@@ -0,0 +1,123 @@
+package proc_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/swipely/iam-docker/src/proc"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("ContainerResolver", func() {
+	const (
+		id      = "4a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+		tcp     = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+		listen  = "   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1111 1 0000000000000000 100 0 0 10 0\n"
+		client  = "   1: 0100000A:C350 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 2222 1 0000000000000000 20 4 30 10 -1\n"
+		tcp6    = "  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+		host    = "   2: 0100007F:1F91 0100007F:1F90 01 00000000:00000000 00:00000000 00000000     0        0 4444 1 0000000000000000 20 4 30 10 -1\n"
+		client6 = "   0: B80D0120000000000000000002000000:C351 B80D0120000000000000000001000000:1F90 01 00000000:00000000 00:00000000 00000000     0        0 3333 1 0000000000000000 20 4 30 10 -1\n"
+	)
+
+	var (
+		root    string
+		subject ContainerResolver
+	)
+
+	write := func(path string, content string) {
+		full := filepath.Join(root, path)
+		Expect(os.MkdirAll(filepath.Dir(full), 0755)).To(BeNil())
+		Expect(ioutil.WriteFile(full, []byte(content), 0644)).To(BeNil())
+	}
+
+	link := func(path string, target string) {
+		full := filepath.Join(root, path)
+		Expect(os.MkdirAll(filepath.Dir(full), 0755)).To(BeNil())
+		Expect(os.Symlink(target, full)).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "iam-docker-proc")
+		Expect(err).To(BeNil())
+		subject = NewContainerResolver(root)
+
+		write("net/tcp", tcp+listen+client+host)
+		write("net/tcp6", tcp6+client6)
+		write("1/cgroup", "0::/init.scope\n")
+		link("1/fd/0", "/dev/null")
+		link("1/fd/3", "socket:[1111]")
+		link("1/fd/4", "socket:[4444]")
+		write("42/cgroup", "12:memory:/docker/"+id+"\n0::/system.slice/docker-"+id+".scope\n")
+		link("42/fd/0", "/dev/null")
+		link("42/fd/5", "socket:[2222]")
+		link("42/fd/6", "socket:[3333]")
+		write("self/cgroup", "")
+	})
+
+	AfterEach(func() {
+		_ = os.RemoveAll(root)
+	})
+
+	Describe("ContainerIDForConnection", func() {
+		Context("When a container process owns the IPv4 socket", func() {
+			It("Returns the container ID", func() {
+				actual, err := subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000})
+				Expect(actual).To(Equal(id))
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Context("When a container process owns the IPv6 socket", func() {
+			It("Returns the container ID", func() {
+				actual, err := subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50001})
+				Expect(actual).To(Equal(id))
+				Expect(err).To(BeNil())
+			})
+		})
+
+		Context("When the socket is owned by a process outside of a container", func() {
+			It("Returns an error", func() {
+				actual, err := subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8081})
+				Expect(actual).To(Equal(""))
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		Context("When the socket was opened after the last lookup", func() {
+			It("Scans again, no more than once per interval", func() {
+				_, _ = subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000})
+				write("net/tcp", tcp+listen+client+host+"   3: 0100000A:C352 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000     0        0 5555 1 0000000000000000 20 4 30 10 -1\n")
+				link("42/fd/7", "socket:[5555]")
+				before := time.Now()
+				actual, err := subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50002})
+				Expect(actual).To(Equal(id))
+				Expect(err).To(BeNil())
+				Expect(time.Since(before)).To(BeNumerically(">", 500*time.Millisecond))
+			})
+		})
+
+		Context("When the socket's file descriptor has been reused", func() {
+			It("Does not return the previous owner", func() {
+				_, _ = subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000})
+				Expect(os.Remove(filepath.Join(root, "42/fd/5"))).To(BeNil())
+				link("42/fd/5", "socket:[9999]")
+				link("1/fd/5", "socket:[2222]")
+				actual, err := subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000})
+				Expect(actual).To(Equal(""))
+				Expect(err).ToNot(BeNil())
+			})
+		})
+
+		Context("When no socket matches the address", func() {
+			It("Returns an error", func() {
+				actual, err := subject.ContainerIDForConnection(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50002})
+				Expect(actual).To(Equal(""))
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+})
@@ -0,0 +1,19 @@
+package proc
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net"
+)
+
+var (
+	log = logrus.WithField("prefix", "proc")
+)
+
+// ContainerResolver finds the container which owns a TCP connection by
+// inspecting the socket tables, file descriptors, and cgroups in procfs. This is
+// used to identify containers which share the host's network namespace.
+type ContainerResolver interface {
+	// Lookup the ID of the container whose process owns the client end of the
+	// TCP connection made from the given address.
+	ContainerIDForConnection(client *net.TCPAddr) (string, error)
+}